@@ -0,0 +1,683 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// controlField is one "Key: value" field of a deb822 stanza (control files,
+// Packages indices, reprepro's conf/distributions).
+type controlField struct {
+	Key   string
+	Value string
+}
+
+// controlStanza keeps fields in file order so they can be written back out
+// unchanged.
+type controlStanza []controlField
+
+func (s controlStanza) Get(key string) string {
+	for _, field := range s {
+		if strings.EqualFold(field.Key, key) {
+			return field.Value
+		}
+	}
+	return ""
+}
+
+func (s controlStanza) String() string {
+	var b strings.Builder
+	for _, field := range s {
+		b.WriteString(field.Key)
+		b.WriteString(":")
+		if !strings.HasPrefix(field.Value, "\n") {
+			b.WriteString(" ")
+		}
+		b.WriteString(field.Value)
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// parseControlStanzas parses deb822 text. Continuation lines (starting with
+// a space or tab) are appended to the previous field's value verbatim.
+func parseControlStanzas(r io.Reader) ([]controlStanza, error) {
+	var stanzas []controlStanza
+	var current controlStanza
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.TrimSpace(line) == "":
+			if len(current) > 0 {
+				stanzas = append(stanzas, current)
+				current = nil
+			}
+		case strings.HasPrefix(line, "#"):
+		case line[0] == ' ' || line[0] == '\t':
+			if len(current) == 0 {
+				return nil, fmt.Errorf("continuation line without a field: %q", line)
+			}
+			current[len(current)-1].Value += "\n" + line
+		default:
+			key, value, ok := strings.Cut(line, ":")
+			if !ok {
+				return nil, fmt.Errorf("malformed line: %q", line)
+			}
+			current = append(current, controlField{Key: key, Value: strings.TrimSpace(value)})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(current) > 0 {
+		stanzas = append(stanzas, current)
+	}
+	return stanzas, nil
+}
+
+// distributionType is one stanza of reprepro's conf/distributions.
+type distributionType struct {
+	Codename      string
+	Suite         string
+	Origin        string
+	Label         string
+	Version       string
+	Description   string
+	Components    []string
+	Architectures []string
+}
+
+func loadDistributions(path string) ([]distributionType, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	stanzas, err := parseControlStanzas(f)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	var dists []distributionType
+	for _, stanza := range stanzas {
+		dist := distributionType{
+			Codename:      stanza.Get("Codename"),
+			Suite:         stanza.Get("Suite"),
+			Origin:        stanza.Get("Origin"),
+			Label:         stanza.Get("Label"),
+			Version:       stanza.Get("Version"),
+			Description:   stanza.Get("Description"),
+			Components:    strings.Fields(stanza.Get("Components")),
+			Architectures: strings.Fields(stanza.Get("Architectures")),
+		}
+		if dist.Codename == "" {
+			return nil, fmt.Errorf("%s: distribution without Codename", path)
+		}
+		if len(dist.Components) == 0 || len(dist.Architectures) == 0 {
+			return nil, fmt.Errorf("%s: %s needs Components and Architectures", path, dist.Codename)
+		}
+		dists = append(dists, dist)
+	}
+	return dists, nil
+}
+
+// debFile is a .deb about to be published.
+type debFile struct {
+	Path    string
+	Control controlStanza
+	Size    int64
+	MD5     string
+	SHA1    string
+	SHA256  string
+}
+
+func (deb debFile) Name() string    { return deb.Control.Get("Package") }
+func (deb debFile) Version() string { return deb.Control.Get("Version") }
+func (deb debFile) Arch() string    { return deb.Control.Get("Architecture") }
+
+// PoolPath is where the deb lives in the repo, following the Debian
+// pool/<component>/<prefix>/<source>/ layout.
+func (deb debFile) PoolPath(component string) string {
+	source := deb.Control.Get("Source")
+	if source == "" {
+		source = deb.Name()
+	} else {
+		// "Source: name (version)" names the source package and its version.
+		source = strings.Fields(source)[0]
+	}
+
+	prefix := source[:1]
+	if strings.HasPrefix(source, "lib") && len(source) > 3 {
+		prefix = source[:4]
+	}
+
+	version := deb.Version()
+	if _, after, ok := strings.Cut(version, ":"); ok {
+		version = after
+	}
+
+	return filepath.ToSlash(filepath.Join("pool", component, prefix, source, fmt.Sprintf("%s_%s_%s.deb", deb.Name(), version, deb.Arch())))
+}
+
+// readDebFile reads the control file out of a .deb and hashes it.
+func readDebFile(path string) (debFile, error) {
+	deb := debFile{Path: path}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return deb, err
+	}
+
+	deb.Size = int64(len(data))
+	md5sum := md5.Sum(data)
+	sha1sum := sha1.Sum(data)
+	sha256sum := sha256.Sum256(data)
+	deb.MD5 = hex.EncodeToString(md5sum[:])
+	deb.SHA1 = hex.EncodeToString(sha1sum[:])
+	deb.SHA256 = hex.EncodeToString(sha256sum[:])
+
+	control, err := readDebControl(bytes.NewReader(data))
+	if err != nil {
+		return deb, fmt.Errorf("reading control of %s: %w", path, err)
+	}
+
+	stanzas, err := parseControlStanzas(bytes.NewReader(control))
+	if err != nil {
+		return deb, fmt.Errorf("parsing control of %s: %w", path, err)
+	}
+	if len(stanzas) != 1 {
+		return deb, fmt.Errorf("control of %s has %d stanzas", path, len(stanzas))
+	}
+	deb.Control = stanzas[0]
+
+	for _, key := range []string{"Package", "Version", "Architecture"} {
+		if deb.Control.Get(key) == "" {
+			return deb, fmt.Errorf("control of %s has no %s", path, key)
+		}
+	}
+	return deb, nil
+}
+
+// readDebControl returns the control file from the control.tar member of
+// the ar archive in r.
+func readDebControl(r io.Reader) ([]byte, error) {
+	magic := make([]byte, 8)
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, err
+	}
+	if string(magic) != "!<arch>\n" {
+		return nil, errors.New("not an ar archive")
+	}
+
+	header := make([]byte, 60)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				return nil, errors.New("no control.tar member")
+			}
+			return nil, err
+		}
+
+		name := strings.TrimSuffix(strings.TrimSpace(string(header[0:16])), "/")
+		size, err := strconv.ParseInt(strings.TrimSpace(string(header[48:58])), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("member %s: bad size: %w", name, err)
+		}
+
+		member := io.LimitReader(r, size)
+		if strings.HasPrefix(name, "control.tar") {
+			return readControlTar(member, strings.TrimPrefix(name, "control.tar"))
+		}
+
+		if _, err := io.Copy(io.Discard, member); err != nil {
+			return nil, err
+		}
+		if size%2 != 0 {
+			if _, err := io.CopyN(io.Discard, r, 1); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+func readControlTar(r io.Reader, ext string) ([]byte, error) {
+	var archiveReader io.Reader
+	switch ext {
+	case "":
+		archiveReader = r
+	case ".gz":
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer func() { _ = gz.Close() }()
+		archiveReader = gz
+	case ".xz":
+		xzr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		archiveReader = xzr
+	case ".zst":
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		archiveReader = zr
+	default:
+		return nil, fmt.Errorf("unsupported control.tar compression %q", ext)
+	}
+
+	tr := tar.NewReader(archiveReader)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil, errors.New("no control file in control.tar")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimPrefix(h.Name, "./") == "control" {
+			return io.ReadAll(tr)
+		}
+	}
+}
+
+// publishRepo lays out an apt repository in repoDir from the .debs matching
+// globs, using the distributions in repoDir/conf/distributions. pool/ and
+// dists/ are regenerated from scratch; when several versions of a package
+// are given, only the newest is published. With a signer every Release is
+// signed and the public key is exported into repoDir.
+func publishRepo(repoDir string, globs []string, signer *openpgp.Entity) error {
+	defer warnTime("publishRepo "+repoDir, 30*time.Second)()
+
+	dists, err := loadDistributions(filepath.Join(repoDir, "conf", "distributions"))
+	if err != nil {
+		return err
+	}
+
+	var paths []string
+	for _, glob := range globs {
+		matches, err := filepath.Glob(glob)
+		if err != nil {
+			return fmt.Errorf("globbing %s: %w", glob, err)
+		}
+		paths = append(paths, matches...)
+	}
+
+	// Keep the newest version of each package/arch.
+	latest := map[string]debFile{}
+	for _, path := range paths {
+		deb, err := readDebFile(path)
+		if err != nil {
+			return err
+		}
+		key := deb.Name() + "/" + deb.Arch()
+		if existing, ok := latest[key]; ok && compareDebVersions(existing.Version(), deb.Version()) >= 0 {
+			slog.Debug("skipping older deb", "path", path, "kept", existing.Path)
+			continue
+		}
+		latest[key] = deb
+	}
+
+	debs := make([]debFile, 0, len(latest))
+	for _, deb := range latest {
+		debs = append(debs, deb)
+	}
+	sort.Slice(debs, func(i, j int) bool {
+		if debs[i].Name() != debs[j].Name() {
+			return debs[i].Name() < debs[j].Name()
+		}
+		return debs[i].Arch() < debs[j].Arch()
+	})
+
+	for _, dir := range []string{"pool", "dists"} {
+		if err := os.RemoveAll(filepath.Join(repoDir, dir)); err != nil {
+			return fmt.Errorf("cleaning %s: %w", dir, err)
+		}
+	}
+
+	now := time.Now().UTC()
+	for _, dist := range dists {
+		if err := publishDistribution(repoDir, dist, debs, now); err != nil {
+			return fmt.Errorf("publishing %s: %w", dist.Codename, err)
+		}
+
+		if signer != nil {
+			if err := signRelease(filepath.Join(repoDir, "dists", dist.Codename), signer); err != nil {
+				return fmt.Errorf("signing %s: %w", dist.Codename, err)
+			}
+		}
+	}
+
+	if signer != nil {
+		if err := exportPublicKey(repoDir, signer); err != nil {
+			return err
+		}
+	} else {
+		slog.Warn("no signing key configured, repository is unsigned")
+	}
+
+	slog.Info("Published repo", "dir", repoDir, "packages", len(debs), "distributions", len(dists))
+	return nil
+}
+
+func publishDistribution(repoDir string, dist distributionType, debs []debFile, date time.Time) error {
+	distDir := filepath.Join(repoDir, "dists", dist.Codename)
+
+	// Every package goes into every component; reprepro's includedeb does
+	// the same with the default component.
+	var indexFiles []string
+	for _, component := range dist.Components {
+		for _, arch := range dist.Architectures {
+			var packages bytes.Buffer
+			for _, deb := range debs {
+				// Architecture: all packages go into every binary-<arch>.
+				if deb.Arch() != arch && deb.Arch() != "all" {
+					continue
+				}
+
+				poolPath := deb.PoolPath(component)
+				if err := placeInPool(deb.Path, filepath.Join(repoDir, poolPath)); err != nil {
+					return err
+				}
+
+				stanza := append(controlStanza{}, deb.Control...)
+				stanza = append(stanza,
+					controlField{Key: "Filename", Value: poolPath},
+					controlField{Key: "Size", Value: strconv.FormatInt(deb.Size, 10)},
+					controlField{Key: "MD5sum", Value: deb.MD5},
+					controlField{Key: "SHA1", Value: deb.SHA1},
+					controlField{Key: "SHA256", Value: deb.SHA256},
+				)
+				if packages.Len() > 0 {
+					packages.WriteString("\n")
+				}
+				packages.WriteString(stanza.String())
+			}
+
+			binaryDir := filepath.Join(component, "binary-"+arch)
+			written, err := writePackagesIndex(filepath.Join(distDir, binaryDir), packages.Bytes())
+			if err != nil {
+				return err
+			}
+
+			release := controlStanza{
+				{Key: "Archive", Value: dist.suiteOrCodename()},
+				{Key: "Origin", Value: dist.Origin},
+				{Key: "Label", Value: dist.Label},
+				{Key: "Component", Value: component},
+				{Key: "Architecture", Value: arch},
+			}.withoutEmpty()
+			if err := os.WriteFile(filepath.Join(distDir, binaryDir, "Release"), []byte(release.String()), 0o644); err != nil {
+				return err
+			}
+			written = append(written, "Release")
+
+			for _, name := range written {
+				indexFiles = append(indexFiles, filepath.ToSlash(filepath.Join(binaryDir, name)))
+			}
+		}
+	}
+
+	return writeRelease(distDir, dist, indexFiles, date)
+}
+
+func (dist distributionType) suiteOrCodename() string {
+	if dist.Suite != "" {
+		return dist.Suite
+	}
+	return dist.Codename
+}
+
+func (s controlStanza) withoutEmpty() controlStanza {
+	var out controlStanza
+	for _, field := range s {
+		if field.Value != "" {
+			out = append(out, field)
+		}
+	}
+	return out
+}
+
+// placeInPool hard links (or copies, across filesystems) src to dst.
+func placeInPool(src, dst string) error {
+	if _, err := os.Stat(dst); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = in.Close() }()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = out.Close() }()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return fmt.Errorf("copying %s to pool: %w", src, err)
+	}
+	return out.Close()
+}
+
+// writePackagesIndex writes Packages, Packages.gz and Packages.xz into dir
+// and returns their names.
+func writePackagesIndex(dir string, packages []byte) ([]string, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "Packages"), packages, 0o644); err != nil {
+		return nil, err
+	}
+
+	var gz bytes.Buffer
+	gzw, err := gzip.NewWriterLevel(&gz, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := gzw.Write(packages); err != nil {
+		return nil, err
+	}
+	if err := gzw.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "Packages.gz"), gz.Bytes(), 0o644); err != nil {
+		return nil, err
+	}
+
+	var xzBuf bytes.Buffer
+	xzw, err := xz.NewWriter(&xzBuf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := xzw.Write(packages); err != nil {
+		return nil, err
+	}
+	if err := xzw.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "Packages.xz"), xzBuf.Bytes(), 0o644); err != nil {
+		return nil, err
+	}
+
+	return []string{"Packages", "Packages.gz", "Packages.xz"}, nil
+}
+
+// writeRelease writes dists/<codename>/Release listing indexFiles (relative
+// to distDir) with their MD5, SHA1 and SHA256 sums.
+func writeRelease(distDir string, dist distributionType, indexFiles []string, date time.Time) error {
+	var md5Lines, sha1Lines, sha256Lines []string
+	for _, name := range indexFiles {
+		data, err := os.ReadFile(filepath.Join(distDir, name))
+		if err != nil {
+			return err
+		}
+		md5sum := md5.Sum(data)
+		sha1sum := sha1.Sum(data)
+		sha256sum := sha256.Sum256(data)
+		md5Lines = append(md5Lines, fmt.Sprintf(" %s %16d %s", hex.EncodeToString(md5sum[:]), len(data), name))
+		sha1Lines = append(sha1Lines, fmt.Sprintf(" %s %16d %s", hex.EncodeToString(sha1sum[:]), len(data), name))
+		sha256Lines = append(sha256Lines, fmt.Sprintf(" %s %16d %s", hex.EncodeToString(sha256sum[:]), len(data), name))
+	}
+
+	release := controlStanza{
+		{Key: "Origin", Value: dist.Origin},
+		{Key: "Label", Value: dist.Label},
+		{Key: "Suite", Value: dist.Suite},
+		{Key: "Version", Value: dist.Version},
+		{Key: "Codename", Value: dist.Codename},
+		{Key: "Date", Value: date.Format(time.RFC1123)},
+		{Key: "Architectures", Value: strings.Join(dist.Architectures, " ")},
+		{Key: "Components", Value: strings.Join(dist.Components, " ")},
+		{Key: "Description", Value: dist.Description},
+		{Key: "MD5Sum", Value: "\n" + strings.Join(md5Lines, "\n")},
+		{Key: "SHA1", Value: "\n" + strings.Join(sha1Lines, "\n")},
+		{Key: "SHA256", Value: "\n" + strings.Join(sha256Lines, "\n")},
+	}.withoutEmpty()
+
+	return os.WriteFile(filepath.Join(distDir, "Release"), []byte(release.String()), 0o644)
+}
+
+// compareDebVersions compares two Debian versions ([epoch:]upstream[-revision])
+// following dpkg's rules and returns -1, 0 or 1.
+func compareDebVersions(a, b string) int {
+	splitVersion := func(v string) (int, string, string) {
+		epoch := 0
+		if before, after, ok := strings.Cut(v, ":"); ok {
+			epoch, _ = strconv.Atoi(before)
+			v = after
+		}
+		revision := ""
+		if idx := strings.LastIndex(v, "-"); idx >= 0 {
+			v, revision = v[:idx], v[idx+1:]
+		}
+		return epoch, v, revision
+	}
+
+	aEpoch, aUpstream, aRevision := splitVersion(a)
+	bEpoch, bUpstream, bRevision := splitVersion(b)
+	if aEpoch != bEpoch {
+		if aEpoch < bEpoch {
+			return -1
+		}
+		return 1
+	}
+	if c := compareDebVersionPart(aUpstream, bUpstream); c != 0 {
+		return c
+	}
+	return compareDebVersionPart(aRevision, bRevision)
+}
+
+// debVersionOrder ranks a non-digit character: "~" sorts before everything
+// (even the end of the string), letters before other characters.
+func debVersionOrder(c byte) int {
+	switch {
+	case c >= '0' && c <= '9':
+		return 0
+	case (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z'):
+		return int(c)
+	case c == '~':
+		return -1
+	case c == 0:
+		return 0
+	default:
+		return int(c) + 256
+	}
+}
+
+func compareDebVersionPart(a, b string) int {
+	at := func(s string, i int) byte {
+		if i < len(s) {
+			return s[i]
+		}
+		return 0
+	}
+	isDigit := func(c byte) bool { return c >= '0' && c <= '9' }
+
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		// Non-digit prefix, compared character by character.
+		for (i < len(a) && !isDigit(a[i])) || (j < len(b) && !isDigit(b[j])) {
+			ac, bc := debVersionOrder(at(a, i)), debVersionOrder(at(b, j))
+			if i < len(a) && isDigit(a[i]) {
+				ac = 0
+			}
+			if j < len(b) && isDigit(b[j]) {
+				bc = 0
+			}
+			if ac != bc {
+				if ac < bc {
+					return -1
+				}
+				return 1
+			}
+			i++
+			j++
+		}
+
+		// Numeric part, compared as numbers.
+		for i < len(a) && a[i] == '0' {
+			i++
+		}
+		for j < len(b) && b[j] == '0' {
+			j++
+		}
+		firstDiff := 0
+		for i < len(a) && isDigit(a[i]) && j < len(b) && isDigit(b[j]) {
+			if firstDiff == 0 && a[i] != b[j] {
+				firstDiff = int(a[i]) - int(b[j])
+			}
+			i++
+			j++
+		}
+		if i < len(a) && isDigit(a[i]) {
+			return 1
+		}
+		if j < len(b) && isDigit(b[j]) {
+			return -1
+		}
+		if firstDiff != 0 {
+			if firstDiff < 0 {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
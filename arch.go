@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+
+	"gopkg.in/yaml.v3"
+)
+
+// archType is one entry of the architecture registry. aliases maps naming
+// schemes (goarch, uname, rust, ...) to this arch's spelling in them; each
+// is available to URL templates as {{ <alias>_architecture }}.
+type archType struct {
+	deb     string
+	optIn   bool
+	aliases map[string]string
+}
+
+// alias returns the arch's name in the given naming scheme.
+func (arch archType) alias(name string) string {
+	if name == "deb" {
+		return arch.deb
+	}
+	return arch.aliases[name]
+}
+
+// archConfigType is an entry of architectures.yaml.
+type archConfigType struct {
+	Deb string `yaml:"deb"`
+	// OptIn arches are only built for packages listing them in
+	// architectures; everything else is built for every other arch.
+	OptIn   bool              `yaml:"opt_in"`
+	Aliases map[string]string `yaml:"aliases"`
+}
+
+var (
+	// allArchs is the architecture registry; archs is the part of it
+	// selected by --arch.
+	allArchs []archType
+	archs    []archType
+
+	// archAll is the pseudo arch of `architectures: [all]` packages: built
+	// once, with "Architecture: all", and published for every arch.
+	archAll = archType{deb: "all"}
+	// buildArchAll is cleared when --arch selects a concrete arch, so the
+	// arch-independent packages are only built by the `--arch all` run.
+	buildArchAll = true
+
+	aliasNameRe = regexp.MustCompile(`^\w+$`)
+)
+
+// loadArchs reads the architecture registry from path into allArchs. Every
+// alias of archAll is "all" so templates resolve the same for it.
+func loadArchs(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	var configs []archConfigType
+	if err := yaml.Unmarshal(data, &configs); err != nil {
+		return fmt.Errorf("decoding %s: %w", path, err)
+	}
+
+	allArchs = nil
+	archAll.aliases = map[string]string{}
+	for _, config := range configs {
+		if config.Deb == "" || config.Deb == archAll.deb {
+			return fmt.Errorf("%s: invalid deb architecture %q", path, config.Deb)
+		}
+		if findArch(config.Deb) != nil {
+			return fmt.Errorf("%s: %s is defined twice", path, config.Deb)
+		}
+		for name := range config.Aliases {
+			if !aliasNameRe.MatchString(name) || name == "deb" {
+				return fmt.Errorf("%s: %s: invalid alias name %q", path, config.Deb, name)
+			}
+			archAll.aliases[name] = archAll.deb
+		}
+		allArchs = append(allArchs, archType{deb: config.Deb, optIn: config.OptIn, aliases: config.Aliases})
+	}
+	if len(allArchs) == 0 {
+		return fmt.Errorf("%s: no architectures defined", path)
+	}
+	archs = allArchs
+	return nil
+}
+
+func findArch(deb string) *archType {
+	for i := range allArchs {
+		if allArchs[i].deb == deb {
+			return &allArchs[i]
+		}
+	}
+	return nil
+}
+
+// validateArchitectures checks a package's architectures list against the
+// registry.
+func validateArchitectures(architectures []string) error {
+	for _, name := range architectures {
+		if name == archAll.deb {
+			if len(architectures) > 1 {
+				return fmt.Errorf("architectures: \"all\" can't be combined with other architectures")
+			}
+			continue
+		}
+		if findArch(name) == nil {
+			return fmt.Errorf("architectures: unknown architecture %q", name)
+		}
+	}
+	return nil
+}
+
+// filterArchs returns the subset of archs that match the given list of
+// architecture names (e.g., ["amd64", "arm64"]). If allowedArchs is nil or
+// empty, all archs that aren't opt-in are returned. ["all"] selects the
+// single architecture-independent build, unless --arch picked a concrete
+// arch.
+func filterArchs(allowedArchs []string) []archType {
+	if len(allowedArchs) == 0 {
+		var result []archType
+		for _, arch := range archs {
+			if !arch.optIn {
+				result = append(result, arch)
+			}
+		}
+		return result
+	}
+	if slices.Contains(allowedArchs, archAll.deb) {
+		if !buildArchAll {
+			return nil
+		}
+		return []archType{archAll}
+	}
+	allowed := make(map[string]bool)
+	for _, a := range allowedArchs {
+		allowed[a] = true
+	}
+	var result []archType
+	for _, arch := range archs {
+		if allowed[arch.deb] {
+			result = append(result, arch)
+		}
+	}
+	return result
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// authConfigType is an entry of auth.yaml (see auth.example.yaml). Secrets
+// are never written into the file itself, only the names of the environment
+// variables holding them.
+type authConfigType struct {
+	Host string `yaml:"host"`
+	// PathPrefix limits the entry to part of the host, e.g. one GitHub
+	// organization. The longest matching entry wins.
+	PathPrefix     string            `yaml:"path_prefix"`
+	BearerTokenEnv string            `yaml:"bearer_token_env"`
+	Username       string            `yaml:"username"`
+	PasswordEnv    string            `yaml:"password_env"`
+	Headers        map[string]string `yaml:"headers"`
+	HeadersEnv     map[string]string `yaml:"headers_env"`
+	// GitHubAPI downloads release assets of github.com through the API
+	// asset endpoint, which unlike the release download URL works for
+	// private repositories.
+	GitHubAPI bool `yaml:"github_api"`
+}
+
+// authType is a loaded auth.yaml entry. err is set when an environment
+// variable it needs is empty, and is returned by requests using it.
+type authType struct {
+	host       string
+	pathPrefix string
+	header     http.Header
+	githubAPI  bool
+	err        error
+}
+
+var (
+	// auths is loaded from --auth-config. Hosts without an entry fall back
+	// to .netrc, and github.com to $GITHUB_TOKEN.
+	auths []authType
+
+	netrcOnce sync.Once
+	netrc     map[string]*authType
+
+	githubReleaseRe = regexp.MustCompile(`^/([^/]+)/([^/]+)/releases/download/([^/]+)/([^/]+)$`)
+	githubAssetRe   = regexp.MustCompile(`^/repos/[^/]+/[^/]+/releases/assets/\d+$`)
+)
+
+// loadAuth reads the per-host credentials from path. A missing file is
+// fine: most packages are public.
+func loadAuth(path string) error {
+	var configs []authConfigType
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("reading %s: %w", path, err)
+	}
+	if err == nil {
+		if err := yaml.Unmarshal(data, &configs); err != nil {
+			return fmt.Errorf("decoding %s: %w", path, err)
+		}
+	}
+
+	auths = nil
+	for i, config := range configs {
+		if config.Host == "" {
+			return fmt.Errorf("%s: entry %d has no host", path, i)
+		}
+		auth := authType{
+			host:       strings.ToLower(config.Host),
+			pathPrefix: config.PathPrefix,
+			header:     http.Header{},
+			githubAPI:  config.GitHubAPI,
+		}
+		for name, value := range config.Headers {
+			auth.header.Set(name, value)
+		}
+		for name, env := range config.HeadersEnv {
+			auth.header.Set(name, auth.env(env))
+		}
+		if config.BearerTokenEnv != "" {
+			auth.header.Set("Authorization", "Bearer "+auth.env(config.BearerTokenEnv))
+		}
+		if config.Username != "" || config.PasswordEnv != "" {
+			auth.setBasicAuth(config.Username, auth.env(config.PasswordEnv))
+		}
+		auths = append(auths, auth)
+	}
+
+	// GITHUB_TOKEN works without any configuration.
+	if token := os.Getenv("GITHUB_TOKEN"); token != "" {
+		for _, host := range []string{"github.com", "api.github.com"} {
+			if findAuth(&url.URL{Host: host, Path: "/"}) == nil {
+				redactSecret(token)
+				auths = append(auths, authType{host: host, header: http.Header{"Authorization": {"Bearer " + token}}})
+			}
+		}
+	}
+	return nil
+}
+
+// env returns the secret in the environment variable name and registers it
+// for redaction.
+func (auth *authType) env(name string) string {
+	value := os.Getenv(name)
+	if value == "" && auth.err == nil {
+		auth.err = fmt.Errorf("credentials for %s: $%s is empty", auth.host, name)
+	}
+	redactSecret(value)
+	return value
+}
+
+func (auth *authType) setBasicAuth(username string, password string) {
+	req := http.Request{Header: auth.header}
+	req.SetBasicAuth(username, password)
+	redactSecret(strings.TrimPrefix(req.Header.Get("Authorization"), "Basic "))
+}
+
+// findAuth returns the entry for u, or nil. Requests to the API of a GitHub
+// repository use the entry of the repository on github.com unless
+// api.github.com has its own.
+func findAuth(u *url.URL) *authType {
+	var found *authType
+	for i, auth := range auths {
+		if auth.host != strings.ToLower(u.Hostname()) || !strings.HasPrefix(u.Path, auth.pathPrefix) {
+			continue
+		}
+		if found == nil || len(auth.pathPrefix) > len(found.pathPrefix) {
+			found = &auths[i]
+		}
+	}
+	if found == nil && u.Hostname() == "api.github.com" {
+		if repoPath, ok := strings.CutPrefix(u.Path, "/repos"); ok {
+			return findAuth(&url.URL{Host: "github.com", Path: repoPath})
+		}
+	}
+	return found
+}
+
+// authorize adds the credentials for req's URL: the matching auth.yaml
+// entry, or else the host's .netrc entry.
+func authorize(req *http.Request) error {
+	if githubAssetRe.MatchString(req.URL.Path) && req.URL.Hostname() == "api.github.com" {
+		req.Header.Set("Accept", "application/octet-stream")
+	}
+
+	auth := findAuth(req.URL)
+	if auth == nil {
+		auth = findNetrc(req.URL.Hostname())
+	}
+	return applyAuth(req, auth)
+}
+
+// applyAuth sets auth's headers on req.
+func applyAuth(req *http.Request, auth *authType) error {
+	if auth == nil {
+		return nil
+	}
+	if auth.err != nil {
+		return fmt.Errorf("%w: %w", errNotRetryable, auth.err)
+	}
+	for name, values := range auth.header {
+		req.Header[name] = values
+	}
+	return nil
+}
+
+// authRedirect moves the credentials of a request to the host it is
+// redirected to: none of them are sent to another host, which only gets its
+// own auth.yaml entry. .netrc isn't consulted, so a redirect can't pick up
+// credentials the user never meant for that host. GitHub redirects asset
+// downloads to a signed storage URL.
+func authRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return fmt.Errorf("stopped after 10 redirects")
+	}
+	if req.URL.Host == via[len(via)-1].URL.Host {
+		return nil
+	}
+
+	req.Header.Del("Authorization")
+	for _, auth := range auths {
+		for name := range auth.header {
+			req.Header.Del(name)
+		}
+	}
+	if auth := findNetrc(via[len(via)-1].URL.Hostname()); auth != nil {
+		for name := range auth.header {
+			req.Header.Del(name)
+		}
+	}
+	return applyAuth(req, findAuth(req.URL))
+}
+
+// githubAssetURL maps a github.com release download URL covered by a
+// github_api entry to its API asset endpoint. Other URLs are returned
+// unchanged.
+func githubAssetURL(logger *slog.Logger, rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Hostname() != "github.com" {
+		return rawURL, nil
+	}
+	auth := findAuth(u)
+	if auth == nil || !auth.githubAPI {
+		return rawURL, nil
+	}
+	m := githubReleaseRe.FindStringSubmatch(u.Path)
+	if m == nil {
+		return rawURL, nil
+	}
+	owner, repo, tag, name := m[1], m[2], m[3], m[4]
+
+	releaseURL := fmt.Sprintf("https://api.github.com/repos/%s/%s/releases/tags/%s", owner, repo, url.PathEscape(tag))
+	data, err := fetchBytes(logger, releaseURL)
+	if err != nil {
+		return "", fmt.Errorf("looking up release %s of %s/%s: %w", tag, owner, repo, err)
+	}
+
+	var release struct {
+		Assets []struct {
+			Name string `json:"name"`
+			URL  string `json:"url"`
+		} `json:"assets"`
+	}
+	if err := json.Unmarshal(data, &release); err != nil {
+		return "", fmt.Errorf("decoding release %s of %s/%s: %w", tag, owner, repo, err)
+	}
+	for _, asset := range release.Assets {
+		if asset.Name == name {
+			return asset.URL, nil
+		}
+	}
+	return "", fmt.Errorf("%w: release %s of %s/%s has no asset %s", errNotRetryable, tag, owner, repo, name)
+}
+
+// findNetrc returns the credentials for host from $NETRC or ~/.netrc.
+func findNetrc(host string) *authType {
+	netrcOnce.Do(func() {
+		path := os.Getenv("NETRC")
+		if path == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return
+			}
+			path = filepath.Join(home, ".netrc")
+		}
+		netrc = parseNetrc(path)
+	})
+	return netrc[strings.ToLower(host)]
+}
+
+// parseNetrc reads the machine entries of a .netrc file. Like cmd/go, it
+// stops at "default": credentials for every host would be sent to whatever
+// a download is mirrored or redirected to. macdef bodies are skipped.
+func parseNetrc(path string) map[string]*authType {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer func() { _ = f.Close() }()
+
+	entries := map[string]*authType{}
+	var host, login, password string
+	var inEntry bool
+	flush := func() {
+		if inEntry && (login != "" || password != "") {
+			if _, ok := entries[host]; !ok {
+				auth := &authType{host: host, header: http.Header{}}
+				auth.setBasicAuth(login, password)
+				redactSecret(password)
+				entries[host] = auth
+			}
+		}
+		host, login, password, inEntry = "", "", "", false
+	}
+
+	scanner := bufio.NewScanner(f)
+	var macdef bool
+lines:
+	for scanner.Scan() {
+		line := scanner.Text()
+		if macdef {
+			macdef = strings.TrimSpace(line) != ""
+			continue
+		}
+		fields := strings.Fields(line)
+		for i := 0; i < len(fields); i++ {
+			next := func() string {
+				if i+1 < len(fields) {
+					i++
+					return fields[i]
+				}
+				return ""
+			}
+			switch fields[i] {
+			case "machine":
+				flush()
+				host, inEntry = strings.ToLower(next()), true
+			case "default":
+				break lines
+			case "login":
+				login = next()
+			case "password":
+				password = next()
+			case "macdef":
+				flush()
+				macdef = true
+				i = len(fields)
+			}
+		}
+	}
+	flush()
+	return entries
+}
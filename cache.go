@@ -0,0 +1,352 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// downloadCache is a content-addressed store shared by every download. Blobs
+// are named by their SHA-256; the index maps a key of URL plus expected
+// digest to a blob, so a version bump that keeps the filename can't reuse
+// stale bytes, and records when each entry was last used for LRU eviction
+// once the blobs exceed maxBytes.
+//
+//	<dir>/index.json
+//	<dir>/blobs/<sha256>
+type downloadCache struct {
+	// dir and maxBytes are set by --cache-dir and --cache-size.
+	dir      string
+	maxBytes int64
+
+	mu     sync.Mutex
+	index  map[string]*cacheEntry
+	pinned map[string]int
+	keyMus map[string]*sync.Mutex
+}
+
+// cacheEntry records where a download came from and what it must contain.
+// An entry whose blob is missing or has the wrong size is downloaded again.
+type cacheEntry struct {
+	URL string `json:"url"`
+	// Source is the URL that served the bytes, a mirror when url failed.
+	Source   string    `json:"source,omitempty"`
+	Size     int64     `json:"size"`
+	SHA256   string    `json:"sha256"`
+	LastUsed time.Time `json:"last_used"`
+}
+
+var cache = &downloadCache{dir: filepath.Join("tmp", "cache"), maxBytes: 10 << 30}
+
+func cacheKey(url string, checksum string) string {
+	sum := sha256.Sum256([]byte(url + "\x00" + checksum))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *downloadCache) blobPath(digest string) string {
+	return filepath.Join(c.dir, "blobs", digest)
+}
+
+// fetch places the bytes of urls[0] at dst, downloading them into the cache
+// first unless a matching entry is there already. The URLs after the first
+// are mirrors, tried in order when it fails; the entry stays keyed by the
+// first. checksum is the expected digest, if known.
+func (c *downloadCache) fetch(logger *slog.Logger, urls []string, checksum string, dst string) error {
+	if checksum != "" {
+		want, err := normalizeChecksum(checksum)
+		if err != nil {
+			return err
+		}
+		checksum = want
+	}
+	key := cacheKey(urls[0], checksum)
+
+	// Jobs asking for the same download wait for the first one.
+	keyMu, err := c.lockKey(key)
+	if err != nil {
+		return err
+	}
+	defer keyMu.Unlock()
+
+	digest, err := c.lookup(logger, key)
+	if err != nil {
+		return err
+	}
+	if digest == "" {
+		var source string
+		if digest, source, err = c.downloadAny(logger, urls, checksum); err != nil {
+			return err
+		}
+		if err := c.add(key, urls[0], source, digest); err != nil {
+			return err
+		}
+	}
+	defer c.unpin(digest)
+
+	return placeFile(c.blobPath(digest), dst)
+}
+
+// lockKey loads the index on first use and returns key's mutex, locked.
+func (c *downloadCache) lockKey(key string) (*sync.Mutex, error) {
+	c.mu.Lock()
+	if c.index == nil {
+		if err := c.load(); err != nil {
+			c.mu.Unlock()
+			return nil, err
+		}
+	}
+	keyMu, ok := c.keyMus[key]
+	if !ok {
+		keyMu = &sync.Mutex{}
+		c.keyMus[key] = keyMu
+	}
+	c.mu.Unlock()
+
+	keyMu.Lock()
+	return keyMu, nil
+}
+
+// lookup returns the digest of key's blob and pins it against eviction, or
+// "" when it has to be downloaded.
+func (c *downloadCache) lookup(logger *slog.Logger, key string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.index[key]
+	if !ok {
+		return "", nil
+	}
+	info, err := os.Stat(c.blobPath(entry.SHA256))
+	if err != nil || info.Size() != entry.Size {
+		logger.Warn("cached download is missing or incomplete, downloading again", "url", entry.URL, "sha256", entry.SHA256)
+		delete(c.index, key)
+		return "", nil
+	}
+
+	logger.Debug("using cached download", "url", entry.URL, "source", entry.Source, "sha256", entry.SHA256)
+	entry.LastUsed = time.Now()
+	if err := c.save(); err != nil {
+		return "", err
+	}
+	c.pinned[entry.SHA256]++
+	return entry.SHA256, nil
+}
+
+// downloadAny tries each of urls in turn and returns the digest of the
+// first download that succeeds and the URL that served it.
+func (c *downloadCache) downloadAny(logger *slog.Logger, urls []string, checksum string) (string, string, error) {
+	var errs []error
+	for i, url := range urls {
+		digest, err := c.download(logger, url, checksum)
+		if err == nil {
+			logger.Info("downloaded", "source", url, "sha256", digest)
+			return digest, url, nil
+		}
+		errs = append(errs, err)
+		if i+1 < len(urls) {
+			logger.Warn("download failed, trying next mirror", "url", url, "next", urls[i+1], "error", err)
+		}
+	}
+	if len(errs) == 1 {
+		return "", "", errs[0]
+	}
+	return "", "", errors.Join(errs...)
+}
+
+// download fetches url into a temp file in the cache and moves it to its
+// blob once complete and verified. It returns the blob's digest.
+func (c *downloadCache) download(logger *slog.Logger, url string, checksum string) (string, error) {
+	defer limitHost(url)()
+
+	file, err := os.CreateTemp(filepath.Join(c.dir, "blobs"), ".*.part")
+	if err != nil {
+		return "", fmt.Errorf("failed to create file: %v", err)
+	}
+	defer func() {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+	}()
+
+	sink := &fileSink{file: file, hasher: sha256.New()}
+	if err := download(logger, url, sink); err != nil {
+		return "", err
+	}
+	if checksum != "" {
+		if err := compareChecksum(checksum, sink.hasher); err != nil {
+			return "", fmt.Errorf("verifying %s: %w", url, err)
+		}
+	}
+
+	if err := file.Sync(); err != nil {
+		return "", err
+	}
+	if err := file.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(file.Name(), 0644); err != nil {
+		return "", err
+	}
+
+	digest := hex.EncodeToString(sink.hasher.Sum(nil))
+	if err := os.Rename(file.Name(), c.blobPath(digest)); err != nil {
+		return "", err
+	}
+	return digest, nil
+}
+
+// add records a downloaded blob under key, pins it and evicts whatever
+// no longer fits.
+func (c *downloadCache) add(key string, url string, source string, digest string) error {
+	info, err := os.Stat(c.blobPath(digest))
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.index[key] = &cacheEntry{URL: url, Source: source, Size: info.Size(), SHA256: digest, LastUsed: time.Now()}
+	c.pinned[digest]++
+	c.evict()
+	if err := c.save(); err != nil {
+		c.pinned[digest]--
+		return err
+	}
+	return nil
+}
+
+func (c *downloadCache) unpin(digest string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.pinned[digest]--
+	if c.pinned[digest] <= 0 {
+		delete(c.pinned, digest)
+	}
+}
+
+// evict removes the least recently used blobs until the rest fit in
+// maxBytes. Blobs in use by a running fetch are kept. c.mu must be held.
+func (c *downloadCache) evict() {
+	blobs := map[string]*cacheEntry{}
+	var total int64
+	for _, entry := range c.index {
+		blob, ok := blobs[entry.SHA256]
+		if !ok {
+			blobs[entry.SHA256] = &cacheEntry{SHA256: entry.SHA256, Size: entry.Size, LastUsed: entry.LastUsed}
+			total += entry.Size
+		} else if entry.LastUsed.After(blob.LastUsed) {
+			blob.LastUsed = entry.LastUsed
+		}
+	}
+	if total <= c.maxBytes {
+		return
+	}
+
+	lru := make([]*cacheEntry, 0, len(blobs))
+	for _, blob := range blobs {
+		lru = append(lru, blob)
+	}
+	slices.SortFunc(lru, func(a, b *cacheEntry) int { return a.LastUsed.Compare(b.LastUsed) })
+
+	for _, blob := range lru {
+		if total <= c.maxBytes {
+			break
+		}
+		if c.pinned[blob.SHA256] > 0 {
+			continue
+		}
+		if err := os.Remove(c.blobPath(blob.SHA256)); err != nil && !os.IsNotExist(err) {
+			slog.Warn("evicting cached download", "sha256", blob.SHA256, "error", err)
+			continue
+		}
+		for key, entry := range c.index {
+			if entry.SHA256 == blob.SHA256 {
+				delete(c.index, key)
+			}
+		}
+		total -= blob.Size
+	}
+}
+
+// load reads the index and drops what an interrupted run left behind:
+// partial downloads, blobs without an entry and entries without a blob.
+// c.mu must be held.
+func (c *downloadCache) load() error {
+	blobsDir := filepath.Join(c.dir, "blobs")
+	if err := os.MkdirAll(blobsDir, 0755); err != nil {
+		return fmt.Errorf("failed to create %s directory: %v", blobsDir, err)
+	}
+
+	index := map[string]*cacheEntry{}
+	data, err := os.ReadFile(filepath.Join(c.dir, "index.json"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &index); err != nil {
+			slog.Warn("discarding unreadable download cache index", "path", filepath.Join(c.dir, "index.json"), "error", err)
+			index = map[string]*cacheEntry{}
+		}
+	}
+
+	referenced := map[string]bool{}
+	for key, entry := range index {
+		if _, err := os.Stat(c.blobPath(entry.SHA256)); err != nil {
+			delete(index, key)
+			continue
+		}
+		referenced[entry.SHA256] = true
+	}
+
+	files, err := os.ReadDir(blobsDir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if !referenced[file.Name()] {
+			_ = os.Remove(filepath.Join(blobsDir, file.Name()))
+		}
+	}
+
+	c.index = index
+	c.pinned = map[string]int{}
+	c.keyMus = map[string]*sync.Mutex{}
+	return nil
+}
+
+// save writes the index through a temp file so it's never seen half
+// written. c.mu must be held.
+func (c *downloadCache) save() error {
+	data, err := json.MarshalIndent(c.index, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(c.dir, "index.json")
+	if err := os.WriteFile(path+".part", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".part", path)
+}
+
+// placeFile atomically replaces dst with a hard link to src, or a copy when
+// they're on different filesystems.
+func placeFile(src string, dst string) error {
+	tmp := dst + ".part"
+	_ = os.Remove(tmp)
+	if err := os.Link(src, tmp); err != nil {
+		if err := copyFile(src, tmp, 0o644); err != nil {
+			_ = os.Remove(tmp)
+			return fmt.Errorf("copying %s to %s: %w", src, dst, err)
+		}
+	}
+	return os.Rename(tmp, dst)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"path"
+	"regexp"
+	"strings"
+)
+
+var (
+	// bsdChecksumRe matches the BSD style "SHA256 (file) = digest" lines
+	// written by `shasum --tag` and `openssl dgst`.
+	bsdChecksumRe = regexp.MustCompile(`^SHA256 \((.+)\) = ([0-9a-fA-F]{64})$`)
+)
+
+// normalizeChecksum accepts a hex SHA-256 digest, optionally prefixed with
+// "sha256:", and returns it lowercased without the prefix.
+func normalizeChecksum(checksum string) (string, error) {
+	sum := strings.ToLower(strings.TrimSpace(checksum))
+	sum = strings.TrimPrefix(sum, "sha256:")
+	if len(sum) != sha256.Size*2 {
+		return "", fmt.Errorf("checksum %q is not a sha256 digest", checksum)
+	}
+	if _, err := hex.DecodeString(sum); err != nil {
+		return "", fmt.Errorf("checksum %q is not a sha256 digest: %w", checksum, err)
+	}
+	return sum, nil
+}
+
+// validateChecksums checks every pinned checksum of a package definition so a
+// typo fails at load time instead of after the download.
+func validateChecksums(app appType) error {
+	for arch, checksum := range app.Checksums {
+		if _, err := normalizeChecksum(checksum); err != nil {
+			return fmt.Errorf("checksums.%s: %w", arch, err)
+		}
+	}
+	for idx, extraFile := range app.ExtraFiles {
+		if extraFile.Checksum == "" {
+			continue
+		}
+		if _, err := normalizeChecksum(extraFile.Checksum); err != nil {
+			return fmt.Errorf("extra_files[%d].checksum: %w", idx, err)
+		}
+	}
+	return nil
+}
+
+// compareChecksum compares the digest accumulated in hasher against the
+// expected checksum.
+func compareChecksum(expected string, hasher hash.Hash) error {
+	want, err := normalizeChecksum(expected)
+	if err != nil {
+		return err
+	}
+	got := hex.EncodeToString(hasher.Sum(nil))
+	if got != want {
+		return fmt.Errorf("checksum mismatch: expected sha256 %s, got %s", want, got)
+	}
+	return nil
+}
+
+// resolveChecksum returns the SHA-256 a download of filename must match. The
+// pinned checksum wins when there is no manifest; when both are set they
+// have to agree. verifyManifest, when set, authenticates the manifest before
+// any of its entries are trusted.
+func resolveChecksum(logger *slog.Logger, pinned string, manifestURL string, filename string, verifyManifest func(io.Reader) error) (string, error) {
+	if manifestURL == "" {
+		return pinned, nil
+	}
+
+	manifest, err := fetchChecksumManifest(logger, manifestURL, verifyManifest)
+	if err != nil {
+		return "", err
+	}
+
+	sum, ok := manifest[filename]
+	if !ok {
+		return "", fmt.Errorf("no sha256 entry for %s in %s", filename, manifestURL)
+	}
+
+	if pinned != "" {
+		want, err := normalizeChecksum(pinned)
+		if err != nil {
+			return "", err
+		}
+		if want != sum {
+			return "", fmt.Errorf("pinned checksum %s disagrees with %s entry %s", want, manifestURL, sum)
+		}
+	}
+
+	logger.Debug("checksum from manifest", "filename", filename, "manifest", manifestURL, "sha256", sum)
+	return sum, nil
+}
+
+// fetchChecksumManifest downloads, optionally verifies, and parses a
+// checksum manifest.
+func fetchChecksumManifest(logger *slog.Logger, url string, verifyManifest func(io.Reader) error) (map[string]string, error) {
+	body, err := fetchBytes(logger, url)
+	if err != nil {
+		return nil, fmt.Errorf("downloading checksum manifest: %w", err)
+	}
+
+	if verifyManifest != nil {
+		if err := verifyManifest(bytes.NewReader(body)); err != nil {
+			return nil, fmt.Errorf("checksum manifest %s: %w", url, err)
+		}
+	}
+
+	manifest, err := parseChecksumManifest(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("parsing checksum manifest %s: %w", url, err)
+	}
+	return manifest, nil
+}
+
+// parseChecksumManifest reads sha256sum style ("digest  file", "digest *file")
+// and BSD style ("SHA256 (file) = digest") lines into a map of file basename
+// to lowercased digest. Lines with other digest lengths are ignored.
+func parseChecksumManifest(r io.Reader) (map[string]string, error) {
+	manifest := map[string]string{}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var sum, name string
+		if m := bsdChecksumRe.FindStringSubmatch(line); m != nil {
+			name, sum = m[1], m[2]
+		} else {
+			fields := strings.Fields(line)
+			if len(fields) != 2 {
+				continue
+			}
+			sum, name = fields[0], strings.TrimPrefix(fields[1], "*")
+		}
+
+		sum, err := normalizeChecksum(sum)
+		if err != nil {
+			continue
+		}
+		manifest[path.Base(name)] = sum
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(manifest) == 0 {
+		return nil, fmt.Errorf("no sha256 entries found")
+	}
+	return manifest, nil
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	protobundle "github.com/sigstore/protobuf-specs/gen/pb-go/bundle/v1"
+	protocommon "github.com/sigstore/protobuf-specs/gen/pb-go/common/v1"
+	protorekor "github.com/sigstore/protobuf-specs/gen/pb-go/rekor/v1"
+	"github.com/sigstore/sigstore-go/pkg/bundle"
+	"github.com/sigstore/sigstore-go/pkg/root"
+	"github.com/sigstore/sigstore-go/pkg/verify"
+)
+
+// cosignType describes a keyless Sigstore/cosign signature published next to
+// a release. Verification is fully offline: the bundle has to carry its
+// transparency log entry and the trust anchors come from a checked-in
+// trusted_root.json.
+type cosignType struct {
+	// BundleURL is a template resolved through ProcessURL pointing at either a
+	// Sigstore bundle (.sigstore.json) or a legacy `cosign sign-blob --bundle`
+	// file. A bare .sig/.pem pair has no log entry and can't be checked offline.
+	BundleURL string `yaml:"bundle_url"`
+	// Target is what the bundle signs: "asset" (default) or "checksums", the
+	// manifest at checksum_url, as goreleaser-built projects usually do.
+	Target string `yaml:"target"`
+	// CertificateIdentity is the expected SAN of the signing certificate,
+	// resolved through ProcessURL so it can pin the release tag.
+	CertificateIdentity       string `yaml:"certificate_identity"`
+	CertificateIdentityRegexp string `yaml:"certificate_identity_regexp"`
+	CertificateOidcIssuer     string `yaml:"certificate_oidc_issuer"`
+	// TrustedRoot is the path of a trusted_root.json relative to the repo
+	// root, defaulting to the public Sigstore instance's in keys/.
+	TrustedRoot string `yaml:"trusted_root"`
+}
+
+const defaultTrustedRoot = "keys/sigstore-trusted-root.json"
+
+func (c *cosignType) trustedRoot() string {
+	if c.TrustedRoot == "" {
+		return defaultTrustedRoot
+	}
+	return c.TrustedRoot
+}
+
+func (c *cosignType) validate(checksumUrl string) error {
+	if c == nil {
+		return nil
+	}
+	if c.BundleURL == "" {
+		return fmt.Errorf("cosign.bundle_url is required")
+	}
+	switch c.Target {
+	case "", "asset":
+	case "checksums":
+		if checksumUrl == "" {
+			return fmt.Errorf("cosign.target \"checksums\" needs checksum_url")
+		}
+	default:
+		return fmt.Errorf("unknown cosign.target %q (want \"asset\" or \"checksums\")", c.Target)
+	}
+	if c.CertificateIdentity == "" && c.CertificateIdentityRegexp == "" {
+		return fmt.Errorf("cosign.certificate_identity or cosign.certificate_identity_regexp is required")
+	}
+	if c.CertificateOidcIssuer == "" {
+		return fmt.Errorf("cosign.certificate_oidc_issuer is required")
+	}
+	if _, err := os.Stat(c.trustedRoot()); err != nil {
+		return fmt.Errorf("cosign.trusted_root: %w", err)
+	}
+	return nil
+}
+
+// verifiesChecksums reports whether the bundle signs the checksum manifest
+// rather than the asset itself.
+func (c *cosignType) verifiesChecksums() bool {
+	return c != nil && c.Target == "checksums"
+}
+
+// manifestVerifier returns the check resolveChecksum runs on the checksum
+// manifest, or nil when the bundle signs the asset instead.
+func (c *cosignType) manifestVerifier(logger *slog.Logger, name string, version string, arch archType) func(io.Reader) error {
+	if !c.verifiesChecksums() {
+		return nil
+	}
+	return func(manifest io.Reader) error {
+		bundleURL, identity, err := c.resolve(name, version, arch)
+		if err != nil {
+			return err
+		}
+		return verifyCosign(logger, c, manifest, bundleURL, identity)
+	}
+}
+
+// resolve renders the bundle URL and certificate identity templates.
+func (c *cosignType) resolve(name string, version string, arch archType) (string, string, error) {
+	bundleURL, err := processFetchURL(c.BundleURL, name, version, arch)
+	if err != nil {
+		return "", "", fmt.Errorf("cosign.bundle_url: %w", err)
+	}
+	identity, err := ProcessURL(c.CertificateIdentity, name, version, arch)
+	if err != nil {
+		return "", "", fmt.Errorf("cosign.certificate_identity: %w", err)
+	}
+	return bundleURL, identity, nil
+}
+
+// verifyCosign checks artifact against the bundle at bundleURL, requiring a
+// certificate for identity issued by the configured OIDC issuer.
+func verifyCosign(logger *slog.Logger, c *cosignType, artifact io.Reader, bundleURL string, identity string) error {
+	defer warnTime("verifyCosign "+bundleURL, 5*time.Second)()
+
+	trustedRoot, err := root.NewTrustedRootFromPath(c.trustedRoot())
+	if err != nil {
+		return fmt.Errorf("loading trusted root %s: %w", c.trustedRoot(), err)
+	}
+
+	// The artifact is needed twice for legacy bundles: once for the digest
+	// the bundle is rebuilt around and once for the signature check.
+	data, err := io.ReadAll(artifact)
+	if err != nil {
+		return fmt.Errorf("reading artifact: %w", err)
+	}
+
+	raw, err := fetchBytes(logger, bundleURL)
+	if err != nil {
+		return fmt.Errorf("downloading cosign bundle: %w", err)
+	}
+
+	entity, err := parseCosignBundle(raw, data)
+	if err != nil {
+		return fmt.Errorf("parsing cosign bundle %s: %w", bundleURL, err)
+	}
+
+	verifier, err := verify.NewSignedEntityVerifier(trustedRoot,
+		verify.WithSignedCertificateTimestamps(1),
+		verify.WithTransparencyLog(1),
+		verify.WithObserverTimestamps(1),
+	)
+	if err != nil {
+		return fmt.Errorf("creating verifier: %w", err)
+	}
+
+	certID, err := verify.NewShortCertificateIdentity(c.CertificateOidcIssuer, "", identity, c.CertificateIdentityRegexp)
+	if err != nil {
+		return fmt.Errorf("certificate identity: %w", err)
+	}
+
+	_, err = verifier.Verify(entity, verify.NewPolicy(verify.WithArtifact(bytes.NewReader(data)), verify.WithCertificateIdentity(certID)))
+	if err != nil {
+		return fmt.Errorf("verifying cosign bundle %s: %w", bundleURL, err)
+	}
+
+	logger.Debug("cosign bundle verified", "bundle", bundleURL, "identity", identity, "issuer", c.CertificateOidcIssuer)
+	return nil
+}
+
+// verifyCosignFile verifies file against the cosign bundle, removing it on
+// failure so a later run can't reuse it.
+func verifyCosignFile(logger *slog.Logger, c *cosignType, file string, bundleURL string, identity string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	err = verifyCosign(logger, c, f, bundleURL, identity)
+	_ = f.Close()
+	if err != nil {
+		_ = os.Remove(file)
+		return err
+	}
+	return nil
+}
+
+// legacyCosignBundle is the file written by `cosign sign-blob --bundle`.
+type legacyCosignBundle struct {
+	Base64Signature string `json:"base64Signature"`
+	Cert            string `json:"cert"`
+	RekorBundle     *struct {
+		SignedEntryTimestamp []byte `json:"SignedEntryTimestamp"`
+		Payload              struct {
+			Body           string `json:"body"`
+			IntegratedTime int64  `json:"integratedTime"`
+			LogIndex       int64  `json:"logIndex"`
+			LogID          string `json:"logID"`
+		} `json:"Payload"`
+	} `json:"rekorBundle"`
+}
+
+// parseCosignBundle loads a Sigstore bundle, converting legacy cosign bundles
+// into an equivalent v0.1 bundle (which only needs an inclusion promise).
+func parseCosignBundle(raw []byte, artifact []byte) (*bundle.Bundle, error) {
+	var probe struct {
+		MediaType       string `json:"mediaType"`
+		Base64Signature string `json:"base64Signature"`
+	}
+	if err := json.Unmarshal(raw, &probe); err != nil {
+		return nil, err
+	}
+
+	if probe.MediaType != "" {
+		var b bundle.Bundle
+		if err := b.UnmarshalJSON(raw); err != nil {
+			return nil, err
+		}
+		return &b, nil
+	}
+
+	if probe.Base64Signature == "" {
+		return nil, errors.New("neither a sigstore bundle nor a cosign bundle")
+	}
+
+	var legacy legacyCosignBundle
+	if err := json.Unmarshal(raw, &legacy); err != nil {
+		return nil, err
+	}
+	if legacy.RekorBundle == nil {
+		return nil, errors.New("cosign bundle has no rekor entry and can't be verified offline")
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(legacy.Base64Signature)
+	if err != nil {
+		return nil, fmt.Errorf("decoding signature: %w", err)
+	}
+
+	certPEM, err := base64.StdEncoding.DecodeString(legacy.Cert)
+	if err != nil {
+		return nil, fmt.Errorf("decoding certificate: %w", err)
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return nil, errors.New("certificate is not PEM encoded")
+	}
+
+	body, err := base64.StdEncoding.DecodeString(legacy.RekorBundle.Payload.Body)
+	if err != nil {
+		return nil, fmt.Errorf("decoding rekor body: %w", err)
+	}
+	var entryKind struct {
+		Kind       string `json:"kind"`
+		APIVersion string `json:"apiVersion"`
+	}
+	if err := json.Unmarshal(body, &entryKind); err != nil {
+		return nil, fmt.Errorf("parsing rekor body: %w", err)
+	}
+
+	logID, err := hex.DecodeString(legacy.RekorBundle.Payload.LogID)
+	if err != nil {
+		return nil, fmt.Errorf("decoding rekor log id: %w", err)
+	}
+
+	mediaType, err := bundle.MediaTypeString("0.1")
+	if err != nil {
+		return nil, err
+	}
+
+	digest := sha256.Sum256(artifact)
+	return bundle.NewBundle(&protobundle.Bundle{
+		MediaType: mediaType,
+		VerificationMaterial: &protobundle.VerificationMaterial{
+			Content: &protobundle.VerificationMaterial_X509CertificateChain{
+				X509CertificateChain: &protocommon.X509CertificateChain{
+					Certificates: []*protocommon.X509Certificate{{RawBytes: block.Bytes}},
+				},
+			},
+			TlogEntries: []*protorekor.TransparencyLogEntry{{
+				LogIndex:       legacy.RekorBundle.Payload.LogIndex,
+				LogId:          &protocommon.LogId{KeyId: logID},
+				KindVersion:    &protorekor.KindVersion{Kind: entryKind.Kind, Version: entryKind.APIVersion},
+				IntegratedTime: legacy.RekorBundle.Payload.IntegratedTime,
+				InclusionPromise: &protorekor.InclusionPromise{
+					SignedEntryTimestamp: legacy.RekorBundle.SignedEntryTimestamp,
+				},
+				CanonicalizedBody: body,
+			}},
+		},
+		Content: &protobundle.Bundle_MessageSignature{
+			MessageSignature: &protocommon.MessageSignature{
+				MessageDigest: &protocommon.HashOutput{
+					Algorithm: protocommon.HashAlgorithm_SHA2_256,
+					Digest:    digest[:],
+				},
+				Signature: sig,
+			},
+		},
+	})
+}
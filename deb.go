@@ -0,0 +1,272 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// debCompressor compresses the control and data members of a .deb.
+type debCompressor struct {
+	ext       string
+	newWriter func(w io.Writer) (io.WriteCloser, error)
+}
+
+var (
+	debCompressors = map[string]debCompressor{
+		"gzip": {ext: ".gz", newWriter: func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriterLevel(w, gzip.BestCompression) }},
+		"xz":   {ext: ".xz", newWriter: func(w io.Writer) (io.WriteCloser, error) { return xz.NewWriter(w) }},
+		"zstd": {ext: ".zst", newWriter: func(w io.Writer) (io.WriteCloser, error) {
+			// A single encoder goroutine keeps the output byte-for-byte stable.
+			return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedBestCompression), zstd.WithEncoderConcurrency(1))
+		}},
+		"none": {ext: "", newWriter: func(w io.Writer) (io.WriteCloser, error) { return nopWriteCloser{w}, nil }},
+	}
+
+	// debCompression is the compressor buildDeb uses, set by --compression.
+	debCompression = "xz"
+)
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// buildDeb packs dir, laid out like `dpkg-deb --build` expects (DEBIAN/ for
+// the control files, everything else as the filesystem), into outDeb. Every
+// entry is owned by root:root so no fakeroot is needed. When sourceDate is
+// set the output is reproducible: entries are sorted and every timestamp is
+// sourceDate.
+func buildDeb(dir, outDeb string, sourceDate time.Time) error {
+	defer warnTime("buildDeb "+dir, 15*time.Second)()
+
+	compressor, ok := debCompressors[debCompression]
+	if !ok {
+		return fmt.Errorf("unknown compression %q", debCompression)
+	}
+
+	debianDir := filepath.Join(dir, "DEBIAN")
+	if _, err := os.Stat(filepath.Join(debianDir, "control")); err != nil {
+		return fmt.Errorf("missing control file: %w", err)
+	}
+
+	controlTar, err := writeDebTar(debianDir, compressor, sourceDate, nil)
+	if err != nil {
+		return fmt.Errorf("writing control.tar: %w", err)
+	}
+	defer func() { _ = os.Remove(controlTar) }()
+
+	dataTar, err := writeDebTar(dir, compressor, sourceDate, func(rel string) bool { return rel == "DEBIAN" })
+	if err != nil {
+		return fmt.Errorf("writing data.tar: %w", err)
+	}
+	defer func() { _ = os.Remove(dataTar) }()
+
+	out, err := os.Create(outDeb)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = out.Close() }()
+
+	mtime := time.Now()
+	if !sourceDate.IsZero() {
+		mtime = sourceDate
+	}
+	if _, err := io.WriteString(out, "!<arch>\n"); err != nil {
+		return err
+	}
+	if err := writeArMember(out, "debian-binary", mtime, strings.NewReader("2.0\n"), 4); err != nil {
+		return err
+	}
+	if err := writeArFile(out, "control.tar"+compressor.ext, mtime, controlTar); err != nil {
+		return err
+	}
+	if err := writeArFile(out, "data.tar"+compressor.ext, mtime, dataTar); err != nil {
+		return err
+	}
+
+	return out.Close()
+}
+
+// writeDebTar writes root as a compressed tar to a temp file and returns its
+// path. Entry names are "./"-relative like dpkg-deb produces and sorted;
+// mtimes are set to sourceDate when it is set; skip prunes relative
+// paths.
+func writeDebTar(root string, compressor debCompressor, sourceDate time.Time, skip func(rel string) bool) (string, error) {
+	tmp, err := os.CreateTemp("", "deb-*.tar")
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = tmp.Close() }()
+
+	err = func() error {
+		cw, err := compressor.newWriter(tmp)
+		if err != nil {
+			return err
+		}
+		tw := tar.NewWriter(cw)
+
+		var paths []string
+		err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			if skip != nil && skip(rel) {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			paths = append(paths, rel)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		sort.Strings(paths)
+
+		for _, rel := range paths {
+			if err := writeDebTarEntry(tw, root, rel, sourceDate); err != nil {
+				return err
+			}
+		}
+
+		if err := tw.Close(); err != nil {
+			return err
+		}
+		return cw.Close()
+	}()
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return "", err
+	}
+
+	return tmp.Name(), tmp.Close()
+}
+
+func writeDebTarEntry(tw *tar.Writer, root string, rel string, sourceDate time.Time) error {
+	path := filepath.Join(root, rel)
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+
+	name := "./"
+	if rel != "." {
+		name = "./" + filepath.ToSlash(rel)
+	}
+
+	// Inputs can be older than sourceDate too: a bare binary or extra file
+	// is a link to its cache blob and carries the time it was downloaded.
+	mtime := info.ModTime()
+	if !sourceDate.IsZero() {
+		mtime = sourceDate
+	}
+
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    int64(info.Mode().Perm()),
+		ModTime: mtime.Truncate(time.Second),
+		Uname:   "root",
+		Gname:   "root",
+		Format:  tar.FormatGNU,
+	}
+
+	switch {
+	case info.IsDir():
+		hdr.Typeflag = tar.TypeDir
+		// Directories come from MkdirAll, their mode is down to the umask.
+		hdr.Mode = 0o755
+		if rel != "." {
+			hdr.Name += "/"
+		}
+	case info.Mode()&fs.ModeSymlink != 0:
+		target, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Linkname = target
+		hdr.Mode = 0o777
+	case info.Mode().IsRegular():
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = info.Size()
+	default:
+		return fmt.Errorf("%s: unsupported file type %s", path, info.Mode().Type())
+	}
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	if hdr.Typeflag != tar.TypeReg {
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	if _, err := io.Copy(tw, f); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// writeArFile appends the file at path to the ar archive as name.
+func writeArFile(w io.Writer, name string, mtime time.Time, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return writeArMember(w, name, mtime, f, info.Size())
+}
+
+// writeArMember writes one member of a common-format ar archive: a fixed
+// 60 byte header followed by the data, padded to an even length.
+func writeArMember(w io.Writer, name string, mtime time.Time, r io.Reader, size int64) error {
+	if len(name) > 16 {
+		return fmt.Errorf("ar member name %q is longer than 16 bytes", name)
+	}
+
+	header := fmt.Sprintf("%-16s%-12d%-6d%-6d%-8o%-10d`\n", name, mtime.Unix(), 0, 0, 0o100644, size)
+	if _, err := io.WriteString(w, header); err != nil {
+		return err
+	}
+
+	n, err := io.Copy(w, r)
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return fmt.Errorf("ar member %s: wrote %d bytes, expected %d", name, n, size)
+	}
+
+	if size%2 != 0 {
+		if _, err := io.WriteString(w, "\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	defaultMaxExtractBytes = 2 << 30
+	defaultMaxExtractFiles = 50_000
+)
+
+// extractor writes archive entries below root, refusing anything that would
+// end up outside of it and enforcing the size and entry count limits.
+type extractor struct {
+	root     string
+	maxBytes int64
+	maxFiles int
+	bytes    int64
+	files    int
+}
+
+// newExtractor creates dst and an extractor for it with the app's limits.
+func newExtractor(app appType, dst string) (*extractor, error) {
+	if err := os.MkdirAll(dst, 0o755); err != nil {
+		return nil, err
+	}
+	root, err := filepath.EvalSymlinks(dst)
+	if err != nil {
+		return nil, err
+	}
+	root, err = filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &extractor{root: root, maxBytes: app.MaxExtractBytes, maxFiles: app.MaxExtractFiles}
+	if e.maxBytes == 0 {
+		e.maxBytes = defaultMaxExtractBytes
+	}
+	if e.maxFiles == 0 {
+		e.maxFiles = defaultMaxExtractFiles
+	}
+	return e, nil
+}
+
+// target returns where the archive entry name is extracted to. Absolute
+// names and names escaping the root with ".." are rejected, as is an entry
+// whose parent directory resolves outside of root through a symlink.
+func (e *extractor) target(name string) (string, error) {
+	e.files++
+	if e.files > e.maxFiles {
+		return "", fmt.Errorf("archive has more than %d entries (max_extract_files)", e.maxFiles)
+	}
+	return e.resolve(name)
+}
+
+func (e *extractor) resolve(name string) (string, error) {
+	if !filepath.IsLocal(filepath.FromSlash(name)) {
+		return "", fmt.Errorf("refusing to extract %q outside of the work dir", name)
+	}
+	target := filepath.Join(e.root, filepath.FromSlash(name))
+	if target == e.root {
+		return target, nil
+	}
+	if err := e.checkInside(filepath.Dir(target)); err != nil {
+		return "", fmt.Errorf("%s: %w", name, err)
+	}
+	return target, nil
+}
+
+// checkInside resolves the symlinks in the existing part of path and
+// fails unless it stays below root.
+func (e *extractor) checkInside(path string) error {
+	for p := path; ; p = filepath.Dir(p) {
+		resolved, err := filepath.EvalSymlinks(p)
+		if errors.Is(err, os.ErrNotExist) && p != e.root {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(e.root, resolved)
+		if err != nil || !filepath.IsLocal(rel) {
+			return fmt.Errorf("%s resolves outside of the work dir", path)
+		}
+		return nil
+	}
+}
+
+func (e *extractor) mkdir(target string) error {
+	if err := e.checkInside(target); err != nil {
+		return err
+	}
+	return os.MkdirAll(target, 0o755)
+}
+
+// writeFile writes r to target with mode, counting the bytes against the
+// limit. An existing file or symlink at target is replaced, never written
+// through.
+func (e *extractor) writeFile(target string, r io.Reader, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+	_ = os.Remove(target)
+
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = out.Close() }()
+
+	n, err := io.Copy(out, io.LimitReader(r, e.maxBytes-e.bytes+1))
+	e.bytes += n
+	if err != nil {
+		return err
+	}
+	if e.bytes > e.maxBytes {
+		return fmt.Errorf("archive extracts to more than %d bytes (max_extract_bytes)", e.maxBytes)
+	}
+	// Chmod rather than OpenFile's perm so the umask doesn't apply.
+	if err := out.Chmod(mode); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// symlink creates target -> linkname, where name is the entry's path in the
+// archive. The link is resolved from the real directory it's created in, so
+// a chain through earlier symlinks can't reach outside the work dir either.
+// Absolute links are rejected, and so are ".." after a name ("a/../..")
+// since the kernel follows a before going up while the check would not.
+func (e *extractor) symlink(name string, target string, linkname string) error {
+	link := filepath.FromSlash(linkname)
+	if filepath.IsAbs(link) || !upLevelsLeading(link) {
+		return fmt.Errorf("refusing symlink %s -> %s pointing outside of the work dir", name, linkname)
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+	parent, err := filepath.EvalSymlinks(filepath.Dir(target))
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(e.root, filepath.Join(parent, link))
+	if err != nil || !filepath.IsLocal(rel) {
+		return fmt.Errorf("refusing symlink %s -> %s pointing outside of the work dir", name, linkname)
+	}
+	_ = os.Remove(target)
+	return os.Symlink(linkname, target)
+}
+
+// upLevelsLeading reports whether every ".." in path comes before its first
+// other element.
+func upLevelsLeading(path string) bool {
+	named := false
+	for _, elem := range strings.Split(path, string(filepath.Separator)) {
+		switch elem {
+		case "", ".":
+		case "..":
+			if named {
+				return false
+			}
+		default:
+			named = true
+		}
+	}
+	return true
+}
+
+// validateExtractLimits checks max_extract_bytes and max_extract_files.
+func validateExtractLimits(app appType) error {
+	if app.MaxExtractBytes < 0 {
+		return fmt.Errorf("max_extract_bytes: must not be negative, got %d", app.MaxExtractBytes)
+	}
+	if app.MaxExtractFiles < 0 {
+		return fmt.Errorf("max_extract_files: must not be negative, got %d", app.MaxExtractFiles)
+	}
+	return nil
+}
+
+// link hard links target to the earlier entry linkname.
+func (e *extractor) link(target string, linkname string) error {
+	src, err := e.resolve(linkname)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+	_ = os.Remove(target)
+	return os.Link(src, target)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"archive/tar"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type tarEntry struct {
+	name     string
+	typeflag byte
+	linkname string
+	body     string
+}
+
+func plainReader(r io.Reader) (io.Reader, error) { return r, nil }
+
+// extractTar writes entries to a tarball and extracts it into a fresh work
+// dir inside a fresh parent, returning the work dir and the error.
+func extractTar(t *testing.T, app appType, entries []tarEntry) (string, error) {
+	t.Helper()
+	dir := t.TempDir()
+
+	archive := filepath.Join(dir, "asset.tar")
+	f, err := os.Create(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(f)
+	for _, entry := range entries {
+		h := &tar.Header{Name: entry.name, Typeflag: entry.typeflag, Linkname: entry.linkname, Mode: 0o644, Size: int64(len(entry.body))}
+		if entry.typeflag == tar.TypeDir {
+			h.Mode = 0o755
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(entry.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	workDir := filepath.Join(dir, "work")
+	e, err := newExtractor(app, workDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return workDir, unarchive(slog.Default(), archive, plainReader, e)
+}
+
+func TestExtractRejectsTraversal(t *testing.T) {
+	tests := map[string][]tarEntry{
+		"dotdot file":         {{name: "../evil", typeflag: tar.TypeReg, body: "x"}},
+		"absolute file":       {{name: "/tmp/evil", typeflag: tar.TypeReg, body: "x"}},
+		"dotdot symlink":      {{name: "l", typeflag: tar.TypeSymlink, linkname: "../evil"}},
+		"absolute symlink":    {{name: "l", typeflag: tar.TypeSymlink, linkname: "/etc"}},
+		"nested dotdot":       {{name: "a/l", typeflag: tar.TypeSymlink, linkname: "../../evil"}},
+		"dotdot after a name": {{name: "a/l", typeflag: tar.TypeSymlink, linkname: "z/../.."}},
+		"dotdot hardlink":     {{name: "l", typeflag: tar.TypeLink, linkname: "../evil"}},
+		"many entries":        {{name: "a", typeflag: tar.TypeReg}, {name: "b", typeflag: tar.TypeReg}, {name: "c", typeflag: tar.TypeReg}},
+		"symlink chain": {
+			{name: "x", typeflag: tar.TypeSymlink, linkname: "."},
+			{name: "x/y", typeflag: tar.TypeSymlink, linkname: ".."},
+		},
+		"symlink chain in subdir": {
+			{name: "a/", typeflag: tar.TypeDir},
+			{name: "a/x", typeflag: tar.TypeSymlink, linkname: ".."},
+			{name: "a/x/y", typeflag: tar.TypeSymlink, linkname: "../.."},
+		},
+		"file through symlinked dir": {
+			{name: "d", typeflag: tar.TypeSymlink, linkname: "."},
+			{name: "d/e", typeflag: tar.TypeSymlink, linkname: ".."},
+			{name: "d/e/evil", typeflag: tar.TypeReg, body: "x"},
+		},
+	}
+	for name, entries := range tests {
+		t.Run(name, func(t *testing.T) {
+			workDir, err := extractTar(t, appType{MaxExtractFiles: 2}, entries)
+			if err == nil {
+				t.Fatal("extracted without error")
+			}
+			parent := filepath.Dir(workDir)
+			if _, err := os.Lstat(filepath.Join(parent, "evil")); err == nil {
+				t.Fatal("wrote outside of the work dir")
+			}
+			_ = filepath.Walk(workDir, func(path string, info os.FileInfo, err error) error {
+				if err != nil || info.Mode()&os.ModeSymlink == 0 {
+					return nil
+				}
+				resolved, err := filepath.EvalSymlinks(path)
+				if err == nil && !strings.HasPrefix(resolved+string(filepath.Separator), workDir+string(filepath.Separator)) {
+					t.Errorf("%s resolves to %s outside of the work dir", path, resolved)
+				}
+				return nil
+			})
+		})
+	}
+}
+
+func TestExtractAllowsLocalLinks(t *testing.T) {
+	workDir, err := extractTar(t, appType{}, []tarEntry{
+		{name: "./", typeflag: tar.TypeDir},
+		{name: "lib64/", typeflag: tar.TypeDir},
+		{name: "lib", typeflag: tar.TypeSymlink, linkname: "./lib64"},
+		{name: "lib64/libfoo.so.1", typeflag: tar.TypeReg, body: "so"},
+		{name: "lib64/libfoo.so", typeflag: tar.TypeSymlink, linkname: "libfoo.so.1"},
+		{name: "bin/tool", typeflag: tar.TypeReg, body: "tool"},
+		{name: "bin/tool-link", typeflag: tar.TypeSymlink, linkname: "../lib/libfoo.so"},
+		{name: "bin/tool-hard", typeflag: tar.TypeLink, linkname: "bin/tool"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(workDir, "bin", "tool-link"))
+	if err != nil || string(data) != "so" {
+		t.Fatalf("bin/tool-link = %q, %v", data, err)
+	}
+}
+
+func TestExtractMaxBytes(t *testing.T) {
+	_, err := extractTar(t, appType{MaxExtractBytes: 4}, []tarEntry{{name: "big", typeflag: tar.TypeReg, body: "12345"}})
+	if err == nil || !strings.Contains(err.Error(), "max_extract_bytes") {
+		t.Fatalf("got %v, want a max_extract_bytes error", err)
+	}
+}
+
+func TestValidateExtractLimits(t *testing.T) {
+	for _, app := range []appType{{MaxExtractBytes: -1}, {MaxExtractFiles: -1}} {
+		if err := validateExtractLimits(app); err == nil {
+			t.Errorf("%+v: negative limit accepted", app)
+		}
+	}
+	if err := validateExtractLimits(appType{MaxExtractBytes: 10, MaxExtractFiles: 10}); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// The http* settings are set by the --http-* flags.
+	httpConnectTimeout = 15 * time.Second
+	// httpIdleTimeout aborts a response whose body stalls for this long.
+	httpIdleTimeout = 60 * time.Second
+	httpRetries     = 4
+	httpRetryWait   = 2 * time.Second
+	// httpMaxRetryWait caps both the backoff and a server's Retry-After.
+	httpMaxRetryWait = 2 * time.Minute
+
+	httpClientOnce sync.Once
+	httpClient     *http.Client
+)
+
+// sharedHTTPClient returns the client all downloads go through, built from
+// the http* settings on first use.
+func sharedHTTPClient() *http.Client {
+	httpClientOnce.Do(func() {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.DialContext = (&net.Dialer{Timeout: httpConnectTimeout, KeepAlive: 30 * time.Second}).DialContext
+		transport.TLSHandshakeTimeout = httpConnectTimeout
+		transport.ResponseHeaderTimeout = httpIdleTimeout
+		httpClient = &http.Client{Transport: transport, CheckRedirect: authRedirect}
+	})
+	return httpClient
+}
+
+// downloadSink receives a download. Reset discards what was written so far,
+// for when a retry has to start over instead of resuming.
+type downloadSink interface {
+	io.Writer
+	Reset() error
+}
+
+// bufferSink is a downloadSink for small files kept in memory.
+type bufferSink struct{ bytes.Buffer }
+
+func (b *bufferSink) Reset() error {
+	b.Buffer.Reset()
+	return nil
+}
+
+// fileSink writes a download to file while hashing it.
+type fileSink struct {
+	file   *os.File
+	hasher hash.Hash
+}
+
+func (f *fileSink) Write(p []byte) (int, error) {
+	n, err := f.file.Write(p)
+	f.hasher.Write(p[:n])
+	return n, err
+}
+
+func (f *fileSink) Reset() error {
+	f.hasher.Reset()
+	if err := f.file.Truncate(0); err != nil {
+		return err
+	}
+	_, err := f.file.Seek(0, io.SeekStart)
+	return err
+}
+
+// errNotRetryable marks failures another attempt won't fix.
+var errNotRetryable = errors.New("not retryable")
+
+// download streams url into sink, sending the credentials configured for its
+// host. Network errors and 408/429/5xx responses are retried with
+// exponential backoff (or the server's Retry-After); a body cut off halfway
+// is resumed with a Range request when the server supports it.
+func download(logger *slog.Logger, url string, sink downloadSink) error {
+	src, err := githubAssetURL(logger, url)
+	if err != nil {
+		return err
+	}
+
+	var written int64
+	for attempt := 0; ; attempt++ {
+		var retryAfter time.Duration
+		written, retryAfter, err = downloadAttempt(src, sink, written)
+		if err == nil {
+			return nil
+		}
+		if errors.Is(err, errNotRetryable) || attempt >= httpRetries {
+			return err
+		}
+
+		wait := httpRetryWait << attempt
+		if retryAfter > 0 {
+			wait = retryAfter
+		}
+		wait = min(wait, httpMaxRetryWait)
+		logger.Warn("download failed, retrying", "url", url, "error", err, "attempt", attempt+1, "wait", wait, "resume_from", written)
+		time.Sleep(wait)
+	}
+}
+
+// downloadAttempt makes one request for url, resuming at offset when it's
+// non-zero. It returns how many bytes sink holds afterwards and how long the
+// server asked to wait before retrying.
+func downloadAttempt(url string, sink downloadSink, offset int64) (int64, time.Duration, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return offset, 0, fmt.Errorf("%w: %w", errNotRetryable, err)
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	if err := authorize(req); err != nil {
+		return offset, 0, err
+	}
+
+	resp, err := sharedHTTPClient().Do(req)
+	if err != nil {
+		return offset, 0, fmt.Errorf("failed to download URL: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		if offset > 0 {
+			// The server ignored the Range header; start over.
+			if err := sink.Reset(); err != nil {
+				return 0, 0, fmt.Errorf("%w: %w", errNotRetryable, err)
+			}
+			offset = 0
+		}
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		if start, ok := contentRangeStart(resp.Header.Get("Content-Range")); !ok || start != offset {
+			// Don't guess where these bytes go; the next attempt starts over.
+			if err := sink.Reset(); err != nil {
+				return 0, 0, fmt.Errorf("%w: %w", errNotRetryable, err)
+			}
+			return 0, 0, fmt.Errorf("unexpected Content-Range %q resuming at %d", resp.Header.Get("Content-Range"), offset)
+		}
+	case retryableStatus(resp.StatusCode):
+		return offset, retryAfter(resp.Header.Get("Retry-After")), fmt.Errorf("failed to download URL %s: status code %d", url, resp.StatusCode)
+	default:
+		return offset, 0, fmt.Errorf("%w: failed to download URL %s: status code %d", errNotRetryable, url, resp.StatusCode)
+	}
+
+	// Abort the request when the body stalls for longer than the idle
+	// timeout; every read pushes the deadline out again.
+	body := &stallReader{r: resp.Body, timer: time.AfterFunc(httpIdleTimeout, cancel)}
+	defer body.timer.Stop()
+
+	n, err := io.Copy(sink, body)
+	if err != nil {
+		return offset + n, 0, fmt.Errorf("failed to read response body: %w", err)
+	}
+	return offset + n, 0, nil
+}
+
+// stallReader pushes timer out by httpIdleTimeout on every read.
+type stallReader struct {
+	r     io.Reader
+	timer *time.Timer
+}
+
+func (s *stallReader) Read(p []byte) (int, error) {
+	s.timer.Reset(httpIdleTimeout)
+	return s.r.Read(p)
+}
+
+func retryableStatus(code int) bool {
+	switch code {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests,
+		http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// retryAfter parses a Retry-After header given in seconds or as a date.
+func retryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(strings.TrimSpace(header)); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		return time.Until(date)
+	}
+	return 0
+}
+
+// contentRangeStart returns the first byte position of a "bytes a-b/n"
+// Content-Range header.
+func contentRangeStart(header string) (int64, bool) {
+	spec, ok := strings.CutPrefix(header, "bytes ")
+	if !ok {
+		return 0, false
+	}
+	start, _, ok := strings.Cut(spec, "-")
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(start, 10, 64)
+	return n, err == nil
+}
@@ -2,19 +2,26 @@ package main
 
 import (
 	"archive/tar"
+	"archive/zip"
+	"cmp"
+	"compress/bzip2"
 	"compress/gzip"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log/slog"
-	"net/http"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"regexp"
+	"slices"
+	"sort"
 	"strings"
 	"time"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/pelletier/go-toml/v2"
 	flag "github.com/spf13/pflag"
 	"github.com/ulikunitz/xz"
@@ -29,6 +36,20 @@ type pkgType struct {
 	Version       string            `yaml:"version"`
 	UrlOverrides  map[string]string `yaml:"url_overrides"`
 	Architectures []string          `yaml:"architectures"`
+	// Mirrors are URL templates tried in order when the download fails.
+	Mirrors []string `yaml:"mirrors"`
+	// MirrorOverrides replaces Mirrors for the arches in UrlOverrides.
+	MirrorOverrides map[string][]string `yaml:"mirror_overrides"`
+	// Checksums pins the expected SHA-256 of the download, keyed by deb arch.
+	Checksums map[string]string `yaml:"checksums"`
+	// ChecksumUrl is a templated upstream checksum manifest (checksums.txt,
+	// SHA256SUMS, ...) the download is verified against.
+	ChecksumUrl string `yaml:"checksum_url"`
+	// Signature is an optional detached signature the download must verify against.
+	Signature *signatureType `yaml:"signature"`
+	// Cosign is an optional Sigstore bundle the download (or its checksum
+	// manifest) must verify against.
+	Cosign *cosignType `yaml:"cosign"`
 }
 
 // cargoType is a Rust crate packaged into a .deb with cargo-deb
@@ -42,6 +63,71 @@ type cargoType struct {
 	Architectures []string `yaml:"architectures"`
 }
 
+// moveRuleType places files from the extracted asset into the package.
+// Rules are applied in order to every extracted file; Kind selects what a
+// rule does:
+//
+//   - "move" (default) links files matching SrcRegex to Dst.
+//   - "exclude" drops files matching SrcRegex from the earlier rules.
+//   - "symlink" creates the symlink Dst -> Target in the package.
+type moveRuleType struct {
+	Kind     string        `yaml:"kind"`
+	SrcRegex regexp.Regexp `yaml:"src_regex"`
+	// Dst may reference capture groups of SrcRegex as $1 or ${name}.
+	Dst string `yaml:"dst"`
+	// Mirror treats Dst as a directory and keeps the matched file's path
+	// relative to the extracted archive below it.
+	Mirror bool `yaml:"mirror"`
+	Mode   int  `yaml:"mode"`
+	// Target is what a symlink rule points at.
+	Target string `yaml:"target"`
+	// Required fails the build when the rule puts no file into the package
+	// (a later exclude dropping all of its matches counts as none), when an
+	// exclude rule matches nothing, or when a symlink's target isn't in the
+	// package.
+	Required bool `yaml:"required"`
+}
+
+func (rule moveRuleType) validate() error {
+	hasRegex := rule.SrcRegex.String() != ""
+	switch rule.Kind {
+	case "", "move":
+		if !hasRegex || rule.Dst == "" {
+			return errors.New("src_regex and dst are required")
+		}
+	case "exclude":
+		if !hasRegex {
+			return errors.New("src_regex is required")
+		}
+		if rule.Dst != "" || rule.Mirror || rule.Mode != 0 {
+			return errors.New("an exclude rule only takes src_regex")
+		}
+	case "symlink":
+		if rule.Dst == "" || rule.Target == "" {
+			return errors.New("dst and target are required")
+		}
+		if hasRegex || rule.Mirror || rule.Mode != 0 {
+			return errors.New("a symlink rule only takes dst and target")
+		}
+	default:
+		return fmt.Errorf("unknown kind %q (want \"move\", \"exclude\" or \"symlink\")", rule.Kind)
+	}
+	if rule.Target != "" && rule.Kind != "symlink" {
+		return errors.New("target is only valid for symlink rules")
+	}
+	if rule.Dst != "" && !filepath.IsLocal(strings.TrimLeft(rule.Dst, "/")) {
+		return fmt.Errorf("dst %q is outside of the package", rule.Dst)
+	}
+	return nil
+}
+
+func (rule moveRuleType) String() string {
+	if rule.Kind == "symlink" {
+		return fmt.Sprintf("%s -> %s", rule.Dst, rule.Target)
+	}
+	return rule.SrcRegex.String()
+}
+
 type alternativeType struct {
 	Name     string `yaml:"name"`
 	Link     string `yaml:"link"`
@@ -57,164 +143,170 @@ type appType struct {
 	UrlOverrides  map[string]string `yaml:"url_overrides"`
 	ArchOverrides map[string]string `yaml:"arch_verrides"`
 	Architectures []string          `yaml:"architectures"`
-	MoveRules     []struct {
-		SrcRegex regexp.Regexp `yaml:"src_regex"`
-		Dst      string        `yaml:"dst"`
-		Mode     int           `yaml:"mode"`
-	} `yaml:"move_rules"`
+	// Mirrors are URL templates tried in order when the download from url
+	// fails, e.g. because github.com is slow or blocked.
+	Mirrors []string `yaml:"mirrors"`
+	// MirrorOverrides replaces Mirrors for an arch with a url_overrides
+	// entry; a mirror of the shared url could serve a different asset, which
+	// the cache would then keep under the override's key.
+	MirrorOverrides map[string][]string `yaml:"mirror_overrides"`
+	// Checksums pins the expected SHA-256 of the release asset, keyed by deb arch.
+	Checksums map[string]string `yaml:"checksums"`
+	// ChecksumUrl is a templated upstream checksum manifest (checksums.txt,
+	// SHA256SUMS, ...) the release asset is verified against.
+	ChecksumUrl string `yaml:"checksum_url"`
+	// Signature is an optional detached signature the release asset must
+	// verify against before it is packaged.
+	Signature *signatureType `yaml:"signature"`
+	// Cosign is an optional Sigstore bundle the release asset (or its
+	// checksum manifest) must verify against.
+	Cosign     *cosignType    `yaml:"cosign"`
+	MoveRules  []moveRuleType `yaml:"move_rules"`
 	ExtraFiles []struct {
-		URL  string `yaml:"url"`
-		Dst  string `yaml:"dst"`
-		Mode int    `yaml:"mode"`
+		URL      string `yaml:"url"`
+		Dst      string `yaml:"dst"`
+		Mode     int    `yaml:"mode"`
+		Checksum string `yaml:"checksum"`
 	} `yaml:"extra_files"`
 	Alternatives []alternativeType `yaml:"alternatives"`
+	// DecompressedName is the file name a single compressed asset (tool.gz,
+	// tool.zst, ...) is decompressed to in the work dir. It defaults to the
+	// asset name without the compression extension.
+	DecompressedName string `yaml:"decompressed_name"`
+	// MaxExtractBytes and MaxExtractFiles cap what the asset may extract to,
+	// guarding against decompression bombs. Zero means the defaults (2 GiB
+	// and 50000 entries).
+	MaxExtractBytes int64 `yaml:"max_extract_bytes"`
+	MaxExtractFiles int   `yaml:"max_extract_files"`
+	// SourceDateEpoch (unix seconds) makes the built .deb reproducible; it
+	// takes precedence over the SOURCE_DATE_EPOCH environment variable.
+	SourceDateEpoch *int64 `yaml:"source_date_epoch"`
+
+	// Control file metadata, see writeControl for the defaults.
+	Description     string `yaml:"description"`
+	LongDescription string `yaml:"long_description"`
+	Homepage        string `yaml:"homepage"`
+	Section         string `yaml:"section"`
+	Priority        string `yaml:"priority"`
+	Maintainer      string `yaml:"maintainer"`
+	License         string `yaml:"license"`
+	// ControlFields are extra raw fields added to the control file as is.
+	ControlFields map[string]string `yaml:"control_fields"`
+	// Depends, Conflicts, ... see relationsType.
+	relationsType `yaml:",inline"`
 }
 
-func (pkg pkgType) BuildURL(arch archType) string {
-	pkgUrl := pkg.Url
+// BuildURLs returns the download URL for arch followed by its mirrors.
+func (pkg pkgType) BuildURLs(arch archType) ([]string, error) {
+	pkgUrl, mirrors := pkg.Url, pkg.Mirrors
 	if val, ok := pkg.UrlOverrides[arch.deb]; ok {
-		pkgUrl = val
+		pkgUrl, mirrors = val, pkg.MirrorOverrides[arch.deb]
 	}
 
-	return ProcessURL(pkgUrl, pkg.Version, arch)
+	return processURLs(append([]string{pkgUrl}, mirrors...), pkg.Name, pkg.Version, arch)
 }
 
-func (app appType) BuildURL(arch archType) string {
+// BuildURLs returns the release asset URL for arch followed by its mirrors.
+func (app appType) BuildURLs(arch archType) ([]string, error) {
 	if val, ok := app.ArchOverrides[arch.deb]; ok {
-		arch = archType{
-			deb:     val,
-			ansible: val,
-			kubectx: val,
+		// An override naming a registered arch takes all of its aliases;
+		// anything else is used verbatim for every alias.
+		if registered := findArch(val); registered != nil {
+			arch = *registered
+		} else {
+			overridden := archType{deb: val, aliases: map[string]string{}}
+			for name := range arch.aliases {
+				overridden.aliases[name] = val
+			}
+			arch = overridden
 		}
 	}
 
-	appUrl := app.Url
+	appUrl, mirrors := app.Url, app.Mirrors
 	if val, ok := app.UrlOverrides[arch.deb]; ok {
-		appUrl = val
+		appUrl, mirrors = val, app.MirrorOverrides[arch.deb]
 	}
 
-	return ProcessURL(appUrl, app.Version, arch)
+	return processURLs(append([]string{appUrl}, mirrors...), app.Name, app.Version, arch)
 }
 
-func ProcessURL(url string, version string, arch archType) string {
+type readerFunc func(r io.Reader) (io.Reader, error)
 
-	values := map[string]string{
-		"version":              version,
-		"deb_architecture":     arch.deb,
-		"ansible_architecture": arch.ansible,
-		"kubectx_architecture": arch.kubectx,
-	}
+func gzipReader(r io.Reader) (io.Reader, error)  { return gzip.NewReader(r) }
+func xzReader(r io.Reader) (io.Reader, error)    { return xz.NewReader(r) }
+func bzip2Reader(r io.Reader) (io.Reader, error) { return bzip2.NewReader(r), nil }
 
-	return templateRe.ReplaceAllStringFunc(url, func(s string) string {
-		varName := templateRe.FindStringSubmatch(s)[1]
-		if val, ok := values[varName]; ok {
-			return val
-		}
-		return s
-	})
-}
-
-type archType struct {
-	deb     string
-	ansible string
-	kubectx string
-	rust    string
+func zstdReader(r io.Reader) (io.Reader, error) {
+	d, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return d.IOReadCloser(), nil
 }
 
-type readerFunc func(r io.Reader) (io.Reader, error)
-
 var (
 	unarchiveFuncs = map[string]readerFunc{
-		".tar.gz": func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
-		".tgz":    func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
-		".tar.xz": func(r io.Reader) (io.Reader, error) { return xz.NewReader(r) },
-		".txz":    func(r io.Reader) (io.Reader, error) { return xz.NewReader(r) },
-	}
-	archs = []archType{
-		{
-			kubectx: "x86_64",
-			deb:     "amd64",
-			ansible: "x86_64",
-			rust:    "x86_64-unknown-linux-gnu",
-		},
-		{
-			deb:     "arm64",
-			kubectx: "arm64",
-			ansible: "aarch64",
-			rust:    "aarch64-unknown-linux-gnu",
-		},
+		".tar.gz":  gzipReader,
+		".tgz":     gzipReader,
+		".tar.xz":  xzReader,
+		".txz":     xzReader,
+		".tar.bz2": bzip2Reader,
+		".tbz2":    bzip2Reader,
+		".tar.zst": zstdReader,
+		".tzst":    zstdReader,
+	}
+	// decompressFuncs handle assets that are a single compressed file rather
+	// than a tarball. They are only consulted when no unarchiveFuncs
+	// extension matched, since ".tar.gz" also ends in ".gz".
+	decompressFuncs = map[string]readerFunc{
+		".gz":  gzipReader,
+		".xz":  xzReader,
+		".bz2": bzip2Reader,
+		".zst": zstdReader,
 	}
 )
 
-var (
-	templateRe = regexp.MustCompile(`{{\s*(?P<var>\w+)\s*}}`)
-)
-
-// filterArchs returns the subset of archs that match the given list of
-// architecture names (e.g., ["amd64", "arm64"]). If allowedArchs is nil or
-// empty, all archs are returned.
-func filterArchs(allowedArchs []string) []archType {
-	if len(allowedArchs) == 0 {
-		return archs
-	}
-	allowed := make(map[string]bool)
-	for _, a := range allowedArchs {
-		allowed[a] = true
-	}
-	var result []archType
-	for _, arch := range archs {
-		if allowed[arch.deb] {
-			result = append(result, arch)
-		}
-	}
-	return result
-}
-
-func downloadURL(dir string, filename string, url string) error {
+// downloadURL fetches urls[0], or failing that each mirror after it in turn,
+// into dir/filename through the download cache. When checksum is set the
+// body is verified before it's cached; a mismatch fails without touching
+// dir/filename.
+func downloadURL(logger *slog.Logger, dir string, filename string, urls []string, checksum string) error {
 	// Create tmp directory if it doesn't exist
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return fmt.Errorf("failed to create %s directory: %v", dir, err)
 	}
 
-	filepath := filepath.Join(dir, filename)
-
-	if _, err := os.Stat(filepath); err == nil {
-		return nil
-	}
-
-	// Download and save file
-	resp, err := http.Get(url)
-	if err != nil {
-		return fmt.Errorf("failed to download URL: %v", err)
-	}
-	defer func() { _ = resp.Body.Close() }()
-
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to download URL %s: status code %d", url, resp.StatusCode)
-	}
-
-	// Save file to directory
-	file, err := os.Create(filepath)
-	if err != nil {
-		return fmt.Errorf("failed to create file: %v", err)
-	}
-	defer func() { _ = file.Close() }()
-
-	if _, err := io.Copy(file, resp.Body); err != nil {
-		return fmt.Errorf("failed to read response body: %v", err)
-	}
-
-	return nil
+	return cache.fetch(logger, urls, checksum, filepath.Join(dir, filename))
 }
 
 func main() {
 	var err error
 
 	var singleApp = flag.String("app", "", "only process single app")
-	var singleArch = flag.String("arch", "", "only build a single arch (e.g. amd64 or arm64)")
+	var singleArch = flag.String("arch", "", "only build a single arch (e.g. amd64 or arm64, or all for the arch-independent packages)")
+	var archConfig = flag.String("arch-config", "architectures.yaml", "architecture registry defining each arch's aliases")
+	var authConfig = flag.String("auth-config", "auth.yaml", "per-host credentials for private downloads (optional)")
+	var jobsFlag = flag.Int("jobs", 4, "number of packages downloaded and built in parallel")
+	var cargoJobsFlag = flag.Int("cargo-jobs", 1, "number of cargo-deb crates built in parallel")
+	flag.IntVar(&hostJobs, "host-jobs", hostJobs, "number of parallel downloads per host")
+	var mirrorRewrites = flag.StringArray("mirror-rewrite", nil, "rewrite URLs starting with PREFIX to start with REPLACEMENT instead, given as PREFIX=REPLACEMENT (repeatable, first match wins)")
+	flag.StringVar(&cache.dir, "cache-dir", cache.dir, "directory of the download cache")
+	var cacheSize = flag.Int64("cache-size", cache.maxBytes>>20, "size of the download cache in MiB; least recently used downloads are evicted beyond it")
+	flag.DurationVar(&httpConnectTimeout, "http-connect-timeout", httpConnectTimeout, "timeout for connecting to a download server")
+	flag.DurationVar(&httpIdleTimeout, "http-idle-timeout", httpIdleTimeout, "abort a download that receives nothing for this long")
+	flag.IntVar(&httpRetries, "http-retries", httpRetries, "number of retries for a failed download")
+	flag.DurationVar(&httpRetryWait, "http-retry-wait", httpRetryWait, "wait before the first retry, doubled for every further one")
+	flag.DurationVar(&httpMaxRetryWait, "http-max-retry-wait", httpMaxRetryWait, "longest wait between retries, including a server's Retry-After")
 	var logLevel = flag.String("log-level", "info", "log level (debug, info, warn, error)")
+	flag.StringVar(&debCompression, "compression", debCompression, "compression for built .deb members (gzip, xz, zstd, none)")
+	var repoDir = flag.String("repo-dir", "repo", "apt repository directory for publish (reads <repo-dir>/conf/distributions)")
+	var signingKey = flag.String("signing-key", "", "OpenPGP private key file used by publish to sign the repository")
+	var signingKeyEnv = flag.String("signing-key-env", "REPO_SIGNING_KEY", "environment variable holding the signing key when --signing-key is not set")
+	var signingPassphraseEnv = flag.String("signing-passphrase-env", "REPO_SIGNING_PASSPHRASE", "environment variable holding the signing key's passphrase")
 	flag.Parse()
 
+	cache.maxBytes = *cacheSize << 20
+
 	// Configure slog based on log level
 	var level slog.Level
 	switch strings.ToLower(*logLevel) {
@@ -230,9 +322,60 @@ func main() {
 		fmt.Fprintf(os.Stderr, "unknown log level %q, using info\n", *logLevel)
 		level = slog.LevelInfo
 	}
-	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+	slog.SetDefault(slog.New(redactHandler{slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})}))
+
+	// Without a command every package is downloaded or built.
+	command := flag.Arg(0)
+	switch command {
+	case "", "verify-reproducible":
+	case "publish":
+		// publish [glob...] includes the given .debs (by default everything
+		// built into tmp/) into the apt repository.
+		globs := flag.Args()[1:]
+		if len(globs) == 0 {
+			globs = []string{filepath.Join("tmp", "*.deb"), filepath.Join("tmp", "*", "*.deb")}
+		}
+		signer, err := loadSigningKey(*signingKey, *signingKeyEnv, *signingPassphraseEnv)
+		if err != nil {
+			slog.Error("loading signing key failed", "error", err)
+			os.Exit(1)
+		}
+		if err := publishRepo(*repoDir, globs, signer); err != nil {
+			slog.Error("publish failed", "error", err)
+			os.Exit(1)
+		}
+		return
+	default:
+		slog.Error("unknown command", "command", command)
+		os.Exit(1)
+	}
+
+	if _, ok := debCompressors[debCompression]; !ok {
+		slog.Error("unknown compression", "compression", debCompression)
+		os.Exit(1)
+	}
+
+	if err := loadArchs(*archConfig); err != nil {
+		slog.Error("loading architectures failed", "error", err)
+		os.Exit(1)
+	}
+	if err := loadAuth(*authConfig); err != nil {
+		slog.Error("loading credentials failed", "error", err)
+		os.Exit(1)
+	}
+	for _, value := range *mirrorRewrites {
+		rewrite, err := parseURLRewrite(value)
+		if err != nil {
+			slog.Error("invalid --mirror-rewrite", "error", err)
+			os.Exit(1)
+		}
+		urlRewrites = append(urlRewrites, rewrite)
+	}
 
-	if singleArch != nil && *singleArch != "" {
+	if singleArch != nil && *singleArch == archAll.deb {
+		archs = nil
+	} else if singleArch != nil && *singleArch != "" {
+		buildArchAll = false
 		var filtered []archType
 		for _, arch := range archs {
 			if arch.deb == *singleArch {
@@ -281,21 +424,29 @@ func main() {
 		}
 	}
 
-	err = downloadDebs(pkgs)
-	if err != nil {
-		slog.Error("downloadDebs failed", "error", err)
-		os.Exit(1)
-	}
-
-	err = downloadApps(apps)
-	if err != nil {
-		slog.Error("downloadApps failed", "error", err)
-		os.Exit(1)
-	}
-
-	err = downloadCargoDebs(cargos)
-	if err != nil {
-		slog.Error("downloadCargoDebs failed", "error", err)
+	switch command {
+	case "":
+	case "verify-reproducible":
+		if err := verifyReproducible(apps); err != nil {
+			slog.Error("verify-reproducible failed", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Cargo builds are CPU bound and get their own, smaller pool next to
+	// the download-bound debs and apps.
+	var cargoErr error
+	cargoDone := make(chan struct{})
+	go func() {
+		defer close(cargoDone)
+		cargoErr = runJobs(cargoJobs(cargos), *cargoJobsFlag)
+	}()
+	err = runJobs(append(debJobs(pkgs), appJobs(apps)...), *jobsFlag)
+	<-cargoDone
+
+	if err := errors.Join(err, cargoErr); err != nil {
+		slog.Error("build failed", "error", err)
 		os.Exit(1)
 	}
 }
@@ -323,17 +474,66 @@ func loadYaml() ([]pkgType, []appType, []cargoType, error) {
 				return fmt.Errorf("decoding %s: %w", match, err)
 			}
 
+			if err := app.validateTemplates(); err != nil {
+				return err
+			}
+
+			for arch := range app.MirrorOverrides {
+				if _, ok := app.UrlOverrides[arch]; !ok {
+					return fmt.Errorf("mirror_overrides.%s: %s has no url_overrides entry", arch, arch)
+				}
+			}
+
+			if err := validateChecksums(app); err != nil {
+				return err
+			}
+
+			if err := app.Signature.validate(); err != nil {
+				return err
+			}
+
+			if err := app.Cosign.validate(app.ChecksumUrl); err != nil {
+				return err
+			}
+
+			if err := app.relationsType.validate(); err != nil {
+				return err
+			}
+
+			if err := validateExtractLimits(app); err != nil {
+				return err
+			}
+
+			for ruleIdx, rule := range app.MoveRules {
+				if err := rule.validate(); err != nil {
+					return fmt.Errorf("move_rules %d: %w", ruleIdx, err)
+				}
+			}
+
+			if err := validateArchitectures(app.Architectures); err != nil {
+				return err
+			}
+			if app.Type == "cargo-deb" && slices.Contains(app.Architectures, archAll.deb) {
+				return fmt.Errorf("architectures: cargo-deb packages can't be \"all\"")
+			}
+
 			// "deb" entries are prebuilt .deb downloads (pkg); "release_asset"
 			// entries are built from release archives/binaries (app);
 			// "cargo-deb" entries are Rust crates built from source with cargo-deb.
 			switch app.Type {
 			case "deb":
 				pkgs = append(pkgs, pkgType{
-					Url:           app.Url,
-					Name:          app.Name,
-					Version:       app.Version,
-					UrlOverrides:  app.UrlOverrides,
-					Architectures: app.Architectures,
+					Url:             app.Url,
+					Name:            app.Name,
+					Version:         app.Version,
+					UrlOverrides:    app.UrlOverrides,
+					Architectures:   app.Architectures,
+					Mirrors:         app.Mirrors,
+					MirrorOverrides: app.MirrorOverrides,
+					Checksums:       app.Checksums,
+					ChecksumUrl:     app.ChecksumUrl,
+					Signature:       app.Signature,
+					Cosign:          app.Cosign,
 				})
 			case "release_asset":
 				apps = append(apps, app)
@@ -358,17 +558,69 @@ func loadYaml() ([]pkgType, []appType, []cargoType, error) {
 
 }
 
-func downloadDebs(pkgs []pkgType) error {
+// debJobs returns a job per package and arch downloading the prebuilt .deb.
+func debJobs(pkgs []pkgType) []job {
+	var jobs []job
 	for _, pkg := range pkgs {
 		for _, arch := range filterArchs(pkg.Architectures) {
-			filename := fmt.Sprintf("%s-%s-%s.deb", pkg.Name, arch.deb, pkg.Version)
-			slog.Info("Downloading", "filename", filename)
-			err := downloadURL(filepath.Join("tmp", arch.deb), filename, pkg.BuildURL(arch))
-			if err != nil {
-				return fmt.Errorf("downloading deb %s: %w", filename, err)
-			}
+			jobs = append(jobs, job{pkg: pkg.Name, arch: arch.deb, run: func(logger *slog.Logger) error {
+				return downloadDeb(logger, pkg, arch)
+			}})
+		}
+	}
+	return jobs
+}
+
+func downloadDeb(logger *slog.Logger, pkg pkgType, arch archType) error {
+	filename := fmt.Sprintf("%s-%s-%s.deb", pkg.Name, arch.deb, pkg.Version)
+	logger.Info("Downloading", "filename", filename)
+	pkgUrls, err := pkg.BuildURLs(arch)
+	if err != nil {
+		return fmt.Errorf("building url for %s: %w", filename, err)
+	}
+	pkgUrl := pkgUrls[0]
+	checksumUrl, err := processFetchURL(pkg.ChecksumUrl, pkg.Name, pkg.Version, arch)
+	if err != nil {
+		return fmt.Errorf("building checksum url for %s: %w", filename, err)
+	}
+	checksum, err := resolveChecksum(logger, pkg.Checksums[arch.deb], checksumUrl, path.Base(pkgUrl), pkg.Cosign.manifestVerifier(logger, pkg.Name, pkg.Version, arch))
+	if err != nil {
+		return fmt.Errorf("resolving checksum for %s: %w", filename, err)
+	}
+	err = downloadURL(logger, filepath.Join("tmp", arch.deb), filename, pkgUrls, checksum)
+	if err != nil {
+		return fmt.Errorf("downloading deb %s: %w", filename, err)
+	}
+	err = verifyDownload(logger, filepath.Join("tmp", arch.deb, filename), pkg.Name, pkg.Version, arch, pkg.Signature, pkg.Cosign)
+	if err != nil {
+		return fmt.Errorf("downloading deb %s: %w", filename, err)
+	}
+	return nil
+}
+
+// verifyDownload runs the signature and cosign checks configured for a
+// package against its downloaded asset.
+func verifyDownload(logger *slog.Logger, file string, name string, version string, arch archType, sig *signatureType, cosign *cosignType) error {
+	if sig != nil {
+		sigURL, err := processFetchURL(sig.URL, name, version, arch)
+		if err != nil {
+			return fmt.Errorf("signature.url: %w", err)
+		}
+		if err := verifySignature(logger, sig, file, sigURL); err != nil {
+			return err
+		}
+	}
+
+	if cosign != nil && !cosign.verifiesChecksums() {
+		bundleURL, identity, err := cosign.resolve(name, version, arch)
+		if err != nil {
+			return err
+		}
+		if err := verifyCosignFile(logger, cosign, file, bundleURL, identity); err != nil {
+			return err
 		}
 	}
+
 	return nil
 }
 
@@ -382,39 +634,113 @@ func getUnarchiveFunc(appUrl string) readerFunc {
 	return nil
 }
 
-func downloadApp(app appType, arch archType) error {
-	var err error
+// getDecompressFunc returns the reader for a single compressed file and the
+// extension it matched.
+func getDecompressFunc(appUrl string) (readerFunc, string) {
+	for ext, decompressFunc := range decompressFuncs {
+		if strings.HasSuffix(appUrl, ext) {
+			return decompressFunc, ext
+		}
+	}
 
+	return nil, ""
+}
+
+func downloadApp(logger *slog.Logger, app appType, arch archType) error {
 	appDir := filepath.Join("tmp", "app", app.Name, arch.deb)
+
+	asset, err := fetchAppAsset(logger, app, arch, appDir)
+	if err != nil {
+		return err
+	}
+
+	outDeb := filepath.Join("tmp", arch.deb, fmt.Sprintf("%s_%s_%s.deb", app.Name, app.Version, arch.deb))
+	return buildApp(logger, app, arch, appDir, asset, outDeb)
+}
+
+// fetchAppAsset downloads and verifies the release asset of app into appDir
+// and returns its path.
+func fetchAppAsset(logger *slog.Logger, app appType, arch archType, appDir string) (string, error) {
+	appUrls, err := app.BuildURLs(arch)
+	if err != nil {
+		return "", fmt.Errorf("building url: %w", err)
+	}
+	appUrl := appUrls[0]
+	filename := filepath.Base(appUrl)
+
+	logger.Info("Downloading App", "path", filepath.Join(appDir, filename))
+
+	checksumUrl, err := processFetchURL(app.ChecksumUrl, app.Name, app.Version, arch)
+	if err != nil {
+		return "", fmt.Errorf("building checksum url: %w", err)
+	}
+	checksum, err := resolveChecksum(logger, app.Checksums[arch.deb], checksumUrl, filename, app.Cosign.manifestVerifier(logger, app.Name, app.Version, arch))
+	if err != nil {
+		return "", fmt.Errorf("resolving checksum for %s: %w", appUrl, err)
+	}
+
+	err = downloadURL(logger, appDir, filename, appUrls, checksum)
+	if err != nil {
+		return "", fmt.Errorf("downloading %s: %w", appUrl, err)
+	}
+
+	err = verifyDownload(logger, filepath.Join(appDir, filename), app.Name, app.Version, arch, app.Signature, app.Cosign)
+	if err != nil {
+		return "", fmt.Errorf("downloading %s: %w", appUrl, err)
+	}
+
+	return filepath.Join(appDir, filename), nil
+}
+
+// buildApp packages the downloaded asset into outDeb. The work and deb trees
+// under appDir are rebuilt from scratch so nothing from an earlier run (or
+// an earlier version) leaks into the package.
+func buildApp(logger *slog.Logger, app appType, arch archType, appDir string, asset string, outDeb string) error {
 	workDir := filepath.Join(appDir, "work")
 	debWorkDir := filepath.Join(appDir, "deb")
 
-	appUrl := app.BuildURL(arch)
+	for _, dir := range []string{workDir, debWorkDir} {
+		if err := os.RemoveAll(dir); err != nil {
+			return fmt.Errorf("cleaning %s: %w", dir, err)
+		}
+	}
 
-	filename := filepath.Base(appUrl)
-	unarchiveFunc := getUnarchiveFunc(appUrl)
+	unarchiveFunc := getUnarchiveFunc(asset)
 	// if unarchiveFunc == nil {
 	// 	if strings.Contains(filename, ".") {
 	// 		return errUnknownExtension
 	// 	}
 	// }
 
-	slog.Info("Downloading App", "path", filepath.Join(appDir, filename))
+	e, err := newExtractor(app, workDir)
+	if err != nil {
+		return fmt.Errorf("creating workDir %s: %w", workDir, err)
+	}
 
-	if unarchiveFunc == nil {
-		err = downloadURL(workDir, filename, appUrl)
+	if strings.HasSuffix(asset, ".zip") {
+		if err := unzip(logger, asset, e); err != nil {
+			return fmt.Errorf("extracting %s: %w", asset, err)
+		}
+	} else if unarchiveFunc != nil {
+		err := unarchive(logger, asset, unarchiveFunc, e)
 		if err != nil {
-			return fmt.Errorf("downloading %s: %w", appUrl, err)
+			return fmt.Errorf("extracting %s: %w", asset, err)
+		}
+	} else if decompressFunc, ext := getDecompressFunc(asset); decompressFunc != nil {
+		name := app.DecompressedName
+		if name == "" {
+			name = strings.TrimSuffix(filepath.Base(asset), ext)
+		}
+		if err := decompress(asset, decompressFunc, e, name); err != nil {
+			return fmt.Errorf("decompressing %s: %w", asset, err)
 		}
 	} else {
-		err = downloadURL(appDir, filename, appUrl)
-		if err != nil {
-			return fmt.Errorf("downloading %s: %w", appUrl, err)
+		// Bare binaries are packaged as downloaded.
+		if err := os.MkdirAll(workDir, 0o755); err != nil {
+			return fmt.Errorf("creating workDir %s: %w", workDir, err)
 		}
-
-		err = unarchive(filepath.Join(appDir, filename), unarchiveFunc, workDir)
-		if err != nil {
-			return fmt.Errorf("extracting %s: %w", filepath.Join(appDir, filename), err)
+		if err := os.Link(asset, filepath.Join(workDir, filepath.Base(asset))); err != nil {
+			return fmt.Errorf("linking %s into %s: %w", asset, workDir, err)
 		}
 	}
 
@@ -424,18 +750,32 @@ func downloadApp(app appType, arch archType) error {
 	}
 
 	for _, extraFile := range app.ExtraFiles {
-		err := downloadURL(filepath.Join(debWorkDir, filepath.Dir(extraFile.Dst)), filepath.Base(extraFile.Dst), ProcessURL(extraFile.URL, app.Version, arch))
+		// Extra files are fetched through the download cache and linked into
+		// the package.
+		extraDir := filepath.Join(appDir, "extra", filepath.Dir(extraFile.Dst))
+		extraUrl, err := processFetchURL(extraFile.URL, app.Name, app.Version, arch)
+		if err != nil {
+			return fmt.Errorf("building extra file url: %w", err)
+		}
+		err = downloadURL(logger, extraDir, filepath.Base(extraFile.Dst), []string{extraUrl}, extraFile.Checksum)
 		if err != nil {
 			return fmt.Errorf("unable to extra url %s: %w", extraFile.URL, err)
 		}
+
+		dst := filepath.Join(debWorkDir, extraFile.Dst)
+		if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+			return fmt.Errorf("creating %s: %w", filepath.Dir(dst), err)
+		}
+		if err := os.Link(filepath.Join(extraDir, filepath.Base(extraFile.Dst)), dst); err != nil {
+			return fmt.Errorf("linking extra file %s: %w", extraFile.Dst, err)
+		}
 	}
 
-	debDir := filepath.Join("tmp", arch.deb)
-	if err := os.MkdirAll(debDir, 0o755); err != nil {
-		return fmt.Errorf("creating %s: %w", debDir, err)
+	if err := os.MkdirAll(filepath.Dir(outDeb), 0o755); err != nil {
+		return fmt.Errorf("creating %s: %w", filepath.Dir(outDeb), err)
 	}
 
-	if err := writeControl(debWorkDir, app.Name, app.Version, arch.deb); err != nil {
+	if err := writeControl(debWorkDir, app, arch.deb); err != nil {
 		return fmt.Errorf("writing control file: %w", err)
 	}
 
@@ -443,24 +783,29 @@ func downloadApp(app appType, arch archType) error {
 		return fmt.Errorf("writing alternatives scripts: %w", err)
 	}
 
-	outDeb := fmt.Sprintf("%s_%s_%s.deb", app.Name, app.Version, arch.deb)
-	if err := buildDeb(debWorkDir, filepath.Join(debDir, outDeb)); err != nil {
+	sourceDate, err := app.SourceDate()
+	if err != nil {
+		return err
+	}
+
+	if err := buildDeb(debWorkDir, outDeb, sourceDate); err != nil {
 		return fmt.Errorf("building deb: %w", err)
 	}
 
 	return nil
 }
 
-func downloadApps(apps []appType) error {
+// appJobs returns a job per release_asset package and arch.
+func appJobs(apps []appType) []job {
+	var jobs []job
 	for _, app := range apps {
 		for _, arch := range filterArchs(app.Architectures) {
-			err := downloadApp(app, arch)
-			if err != nil {
-				return fmt.Errorf("downloading apps %s: %w", app.Name, err)
-			}
+			jobs = append(jobs, job{pkg: app.Name, arch: arch.deb, run: func(logger *slog.Logger) error {
+				return downloadApp(logger, app, arch)
+			}})
 		}
 	}
-	return nil
+	return jobs
 }
 
 func processApp(app appType, workDir string, debWorkDir string) error {
@@ -476,6 +821,7 @@ func processApp(app appType, workDir string, debWorkDir string) error {
 		return fmt.Errorf("creating debWorkDir %s: %w", debWorkDir, err)
 	}
 
+	matched := make([]int, len(app.MoveRules))
 	err := filepath.Walk(workDir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
@@ -485,28 +831,71 @@ func processApp(app appType, workDir string, debWorkDir string) error {
 			return nil
 		}
 
+		type placement struct {
+			ruleIdx int
+			dst     string
+		}
+		var placements []placement
+
+		filenameWithoutWork := path[len(workDir)+1:]
 		for ruleIdx, rule := range app.MoveRules {
-			filenameWithoutWork := path[len(workDir)+1:]
+			if rule.Kind == "symlink" {
+				continue
+			}
 			// fmt.Printf("Processing file %s with regex %s == %t\n", filenameWithoutWork, rule.SrcRegex.String(), rule.SrcRegex.MatchString(filenameWithoutWork))
-			if !rule.SrcRegex.MatchString(filenameWithoutWork) {
+			match := rule.SrcRegex.FindStringSubmatchIndex(filenameWithoutWork)
+			if match == nil {
 				continue
 			}
+			if rule.Kind == "exclude" {
+				matched[ruleIdx]++
+				placements = nil
+				continue
+			}
+
+			dst := string(rule.SrcRegex.ExpandString(nil, rule.Dst, filenameWithoutWork, match))
+			if rule.Mirror {
+				dst = filepath.Join(dst, filenameWithoutWork)
+			}
+			if !filepath.IsLocal(strings.TrimLeft(dst, "/")) {
+				return fmt.Errorf("processing app %s's %d: destination %q for %s is outside of the package", app.Name, ruleIdx, dst, filenameWithoutWork)
+			}
+			placements = append(placements, placement{ruleIdx: ruleIdx, dst: dst})
+		}
 
-			newFile := filepath.Join(debWorkDir, rule.Dst)
+		// Only placements a later exclude didn't drop count for required.
+		for _, p := range placements {
+			ruleIdx, rule := p.ruleIdx, app.MoveRules[p.ruleIdx]
+			matched[ruleIdx]++
+			newFile := filepath.Join(debWorkDir, p.dst)
 			if err := os.MkdirAll(filepath.Dir(newFile), 0o755); err != nil {
 				return fmt.Errorf("processing app %s's %d mkdir: %w", app.Name, ruleIdx, err)
 			}
 
 			madeChanges = true
 			os.Remove(newFile)
-			err = os.Link(path, newFile)
-			if err != nil {
-				return fmt.Errorf("processing app %s's %d moving file %s to %s: %w", app.Name, ruleIdx, path, newFile, err)
+			if info.Mode()&fs.ModeSymlink != 0 {
+				// Symlinks are recreated as is, chmod would follow them.
+				target, err := os.Readlink(path)
+				if err != nil {
+					return fmt.Errorf("processing app %s's %d reading symlink %s: %w", app.Name, ruleIdx, path, err)
+				}
+				if err := os.Symlink(target, newFile); err != nil {
+					return fmt.Errorf("processing app %s's %d linking %s to %s: %w", app.Name, ruleIdx, newFile, target, err)
+				}
+				continue
 			}
 
-			err = os.Chmod(newFile, os.FileMode(rule.Mode))
+			// Mode 0 keeps the mode the file had upstream. A different mode
+			// gets its own copy: chmod on a hard link would also change the
+			// extracted file and every other link to it.
+			if rule.Mode == 0 || os.FileMode(rule.Mode) == info.Mode().Perm() {
+				err = os.Link(path, newFile)
+			} else {
+				err = copyFile(path, newFile, os.FileMode(rule.Mode))
+			}
 			if err != nil {
-				return fmt.Errorf("processing app %s's %d setting permissions on file %s to %d: %w", app.Name, ruleIdx, newFile, rule.Mode, err)
+				return fmt.Errorf("processing app %s's %d moving file %s to %s: %w", app.Name, ruleIdx, path, newFile, err)
 			}
 		}
 		return nil
@@ -516,13 +905,69 @@ func processApp(app appType, workDir string, debWorkDir string) error {
 		return fmt.Errorf("processing app %s: %w", app.Name, err)
 	}
 
+	for ruleIdx, rule := range app.MoveRules {
+		if rule.Kind != "symlink" {
+			continue
+		}
+		newFile := filepath.Join(debWorkDir, rule.Dst)
+		if err := os.MkdirAll(filepath.Dir(newFile), 0o755); err != nil {
+			return fmt.Errorf("processing app %s's %d mkdir: %w", app.Name, ruleIdx, err)
+		}
+		os.Remove(newFile)
+		if err := os.Symlink(rule.Target, newFile); err != nil {
+			return fmt.Errorf("processing app %s's %d linking %s to %s: %w", app.Name, ruleIdx, newFile, rule.Target, err)
+		}
+
+		// The target is resolved inside the package, not on this machine.
+		target := rule.Target
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(rule.Dst), target)
+		}
+		if _, err := os.Lstat(filepath.Join(debWorkDir, target)); err == nil {
+			matched[ruleIdx]++
+		}
+	}
+
+	var missing []string
+	for ruleIdx, rule := range app.MoveRules {
+		if rule.Required && matched[ruleIdx] == 0 {
+			missing = append(missing, fmt.Sprintf("%d (%s)", ruleIdx, rule))
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("processing app %s: required move_rules matched nothing: %s", app.Name, strings.Join(missing, ", "))
+	}
+
 	if !madeChanges {
 		return errors.New("no assets found")
 	}
 	return nil
 }
 
-func unarchive(file string, reader readerFunc, dst string) error {
+// copyFile copies src to dst and sets dst's mode to mode.
+func copyFile(src string, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = in.Close() }()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = out.Close() }()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	if err := out.Chmod(mode); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+func unarchive(logger *slog.Logger, file string, reader readerFunc, e *extractor) error {
 	defer warnTime("unarchive "+file, time.Second)()
 	f, err := os.Open(file)
 	if err != nil {
@@ -549,52 +994,193 @@ func unarchive(file string, reader readerFunc, dst string) error {
 			return err
 		}
 
-		target := filepath.Join(dst, h.Name)
+		target, err := e.target(h.Name)
+		if err != nil {
+			return err
+		}
 		switch h.Typeflag {
 		case tar.TypeDir:
-			if err := os.MkdirAll(target, 0o755); err != nil {
-				return err
-			}
+			err = e.mkdir(target)
 		case tar.TypeReg:
+			err = e.writeFile(target, tr, h.FileInfo().Mode().Perm())
+		case tar.TypeSymlink:
+			err = e.symlink(h.Name, target, h.Linkname)
+		case tar.TypeLink:
+			err = e.link(target, h.Linkname)
+		default:
+			logger.Debug("skipping tar entry", "name", h.Name, "type", string(h.Typeflag))
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", h.Name, err)
+		}
+	}
+	return nil
+}
+
+// decompress writes the single compressed file at file to name in the work
+// dir. The result is made executable since such assets are almost always a
+// bare binary.
+func decompress(file string, reader readerFunc, e *extractor, name string) error {
+	defer warnTime("decompress "+file, time.Second)()
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	r, err := reader(f)
+	if err != nil {
+		return err
+	}
+	if closeReader, ok := r.(io.ReadCloser); ok {
+		defer func() { _ = closeReader.Close() }()
+	}
+
+	target, err := e.target(name)
+	if err != nil {
+		return err
+	}
+	return e.writeFile(target, r, 0o755)
+}
+
+// unzip extracts a zip archive into the work dir. Unlike tarballs a zip
+// can't be streamed (the central directory is at the end), so it doesn't go
+// through readerFunc. File modes come from the external attributes, so
+// executables zipped on Unix stay executable.
+func unzip(logger *slog.Logger, file string, e *extractor) error {
+	defer warnTime("unzip "+file, time.Second)()
+	zr, err := zip.OpenReader(file)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = zr.Close() }()
+
+	for _, zf := range zr.File {
+		target, err := e.target(zf.Name)
+		if err != nil {
+			return err
+		}
+		mode := zf.Mode()
+		switch {
+		case mode.IsDir():
+			err = e.mkdir(target)
+		case mode.IsRegular():
 			err = func() error {
-				if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+				in, err := zf.Open()
+				if err != nil {
 					return err
 				}
-				out, err := os.Create(target)
+				defer func() { _ = in.Close() }()
+				return e.writeFile(target, in, mode.Perm())
+			}()
+		case mode&fs.ModeSymlink != 0:
+			err = func() error {
+				in, err := zf.Open()
 				if err != nil {
 					return err
 				}
-				defer func() { _ = out.Close() }()
+				defer func() { _ = in.Close() }()
 
-				_, err = io.Copy(out, tr)
-				return err
+				// A zip symlink stores its target as the entry's content.
+				linkname, err := io.ReadAll(io.LimitReader(in, 4096))
+				if err != nil {
+					return err
+				}
+				return e.symlink(zf.Name, target, string(linkname))
 			}()
-			if err != nil {
-				return err
-			}
 		default:
-			slog.Debug("skipping tar entry", "name", h.Name, "type", string(h.Typeflag))
+			logger.Debug("skipping zip entry", "name", zf.Name, "mode", mode.String())
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", zf.Name, err)
 		}
 	}
 	return nil
 }
 
-func writeControl(dir string, name, version, arch string) error {
+const (
+	defaultMaintainer = "Gavin Mogan <debian@gavinmogan.com>"
+	defaultSection    = "extra"
+	defaultPriority   = "optional"
+)
+
+// writeControl writes DEBIAN/control from the app's metadata. Section,
+// Priority, Maintainer and Description fall back to the values every package
+// used to get; a multi-line description is split into the synopsis (first
+// line) and the extended description.
+func writeControl(dir string, app appType, arch string) error {
 	defer warnTime("writeControl "+dir, time.Second)()
 	debianDir := filepath.Join(dir, "DEBIAN")
 	if err := os.MkdirAll(debianDir, 0755); err != nil {
 		return fmt.Errorf("failed to create %s directory: %v", debianDir, err)
 	}
 
-	ctrl := fmt.Sprintf(`Package: %s
-Version: %s
-Architecture: %s
-Maintainer: Gavin Mogan <debian@gavinmogan.com>
-Section: extra
-Priority: optional
-Description: %s packaged from tgz
-`, name, version, arch, name)
-	return os.WriteFile(filepath.Join(debianDir, "control"), []byte(ctrl), 0o644)
+	ctrl, err := app.controlStanza(arch)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(debianDir, "control"), []byte(ctrl.String()), 0o644)
+}
+
+func (app appType) controlStanza(arch string) (controlStanza, error) {
+	synopsis, long, _ := strings.Cut(strings.TrimSpace(app.Description), "\n")
+	synopsis = strings.TrimSpace(synopsis)
+	if synopsis == "" {
+		synopsis = app.Name + " packaged from tgz"
+	}
+	long = strings.TrimSpace(strings.TrimSpace(long) + "\n\n" + strings.TrimSpace(app.LongDescription))
+
+	ctrl := controlStanza{
+		{Key: "Package", Value: app.Name},
+		{Key: "Version", Value: app.Version},
+		{Key: "Architecture", Value: arch},
+		{Key: "Maintainer", Value: cmp.Or(app.Maintainer, defaultMaintainer)},
+		{Key: "Section", Value: cmp.Or(app.Section, defaultSection)},
+		{Key: "Priority", Value: cmp.Or(app.Priority, defaultPriority)},
+		{Key: "Homepage", Value: app.Homepage},
+		{Key: "License", Value: app.License},
+	}.withoutEmpty()
+	ctrl = append(ctrl, app.relationFields(arch)...)
+
+	keys := make([]string, 0, len(app.ControlFields))
+	for key := range app.ControlFields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if ctrl.Get(key) != "" || strings.EqualFold(key, "Description") {
+			return nil, fmt.Errorf("control_fields.%s clashes with a generated field", key)
+		}
+		if strings.ContainsAny(key, ": \t\n") {
+			return nil, fmt.Errorf("control_fields.%s is not a valid field name", key)
+		}
+		value := strings.TrimSpace(app.ControlFields[key])
+		if strings.Contains(value, "\n") {
+			return nil, fmt.Errorf("control_fields.%s must be a single line", key)
+		}
+		ctrl = append(ctrl, controlField{Key: key, Value: value})
+	}
+
+	return append(ctrl, controlField{Key: "Description", Value: formatDescription(synopsis, long)}), nil
+}
+
+// formatDescription joins a synopsis and an extended description the way
+// control files expect: every extended line is indented by one space and
+// blank lines become " .".
+func formatDescription(synopsis string, long string) string {
+	if long == "" {
+		return synopsis
+	}
+
+	lines := []string{synopsis}
+	for _, line := range strings.Split(long, "\n") {
+		line = strings.TrimRight(line, " \t")
+		if line == "" {
+			line = "."
+		}
+		lines = append(lines, " "+line)
+	}
+	return strings.Join(lines, "\n")
 }
 
 func writeAlternativesScripts(dir string, alternatives []alternativeType) error {
@@ -640,36 +1226,38 @@ func writeAlternativesScripts(dir string, alternatives []alternativeType) error
 	return nil
 }
 
-func buildDeb(dir, outDeb string) error {
-	defer warnTime("buildDeb "+dir, 15*time.Second)()
-	cmd := exec.Command("fakeroot", "dpkg-deb", "--build", dir, outDeb)
-	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
-	return cmd.Run()
-}
+// runCommand runs name in dir, prefixing every line of its output with tag.
+func runCommand(tag string, dir, name string, args ...string) error {
+	slog.Debug("running command", "tag", tag, "dir", dir, "cmd", name, "args", strings.Join(args, " "))
+	stdout, stderr := newPrefixWriter(os.Stdout, tag), newPrefixWriter(os.Stderr, tag)
+	defer func() { _, _ = stdout.Flush(), stderr.Flush() }()
 
-// runCommand runs name+args in dir (cwd when empty), streaming output.
-func runCommand(dir, name string, args ...string) error {
-	slog.Debug("running command", "dir", dir, "cmd", name, "args", strings.Join(args, " "))
 	cmd := exec.Command(name, args...)
 	cmd.Dir = dir
-	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.Stdout, cmd.Stderr = stdout, stderr
 	return cmd.Run()
 }
 
-func downloadCargoDebs(cargos []cargoType) error {
+// cargoJobs returns a job per crate building every arch in turn, since the
+// arches share one checkout.
+func cargoJobs(cargos []cargoType) []job {
+	var jobs []job
 	for _, cargo := range cargos {
-		for _, arch := range filterArchs(cargo.Architectures) {
-			if err := buildCargoDeb(cargo, arch); err != nil {
-				return fmt.Errorf("building cargo-deb %s for %s: %w", cargo.Name, arch.deb, err)
+		jobs = append(jobs, job{pkg: cargo.Name, run: func(logger *slog.Logger) error {
+			for _, arch := range filterArchs(cargo.Architectures) {
+				if err := buildCargoDeb(logger.With("arch", arch.deb), cargo, arch); err != nil {
+					return fmt.Errorf("building cargo-deb %s for %s: %w", cargo.Name, arch.deb, err)
+				}
 			}
-		}
+			return nil
+		}})
 	}
-	return nil
+	return jobs
 }
 
 // buildCargoDeb clones a Rust crate, checks out its ref, and runs cargo-deb to
 // produce a .deb for the given arch in tmp/<arch>/.
-func buildCargoDeb(cargo cargoType, arch archType) error {
+func buildCargoDeb(logger *slog.Logger, cargo cargoType, arch archType) error {
 	defer warnTime("buildCargoDeb "+cargo.Name+" "+arch.deb, 60*time.Second)()
 
 	debDir := filepath.Join("tmp", arch.deb)
@@ -737,7 +1325,7 @@ func buildCargoDeb(cargo cargoType, arch archType) error {
 		debMap["priority"] = "optional"
 	}
 
-	slog.Debug("Cargo.toml needs changing", "needsChanging", needsChanging)
+	logger.Debug("Cargo.toml needs changing", "needsChanging", needsChanging)
 
 	if needsChanging {
 		tomlFile, err = os.Create(filepath.Join(srcDir, "Cargo.toml"))
@@ -760,17 +1348,18 @@ func buildCargoDeb(cargo cargoType, arch archType) error {
 
 	// Skip if already built (e.g. restored from the CI package cache).
 	if _, err := os.Stat(outDeb); err == nil {
-		slog.Info("cargo-deb already built, skipping", "name", cargo.Name, "arch", arch.deb)
+		logger.Info("cargo-deb already built, skipping")
 		return nil
 	}
 
-	slog.Info("Building with zigbuild", "name", cargo.Name, "arch", arch.deb, "target", arch.rust)
-	if err := runCommand(srcDir, "fakeroot", "cargo", "zigbuild", "--release", "--target", arch.rust); err != nil {
+	tag := cargo.Name + "/" + arch.deb
+	logger.Info("Building with zigbuild", "target", arch.alias("rust"))
+	if err := runCommand(tag, srcDir, "fakeroot", "cargo", "zigbuild", "--release", "--target", arch.alias("rust")); err != nil {
 		return fmt.Errorf("cargo zigbuild: %w", err)
 	}
 
-	slog.Info("Building cargo-deb", "name", cargo.Name, "arch", arch.deb, "target", arch.rust)
-	if err := runCommand(srcDir, "fakeroot", "cargo", "deb", "--no-strip", "--no-build", "--target", arch.rust, "--output", outDeb); err != nil {
+	logger.Info("Building cargo-deb", "target", arch.alias("rust"))
+	if err := runCommand(tag, srcDir, "fakeroot", "cargo", "deb", "--no-strip", "--no-build", "--target", arch.alias("rust"), "--output", outDeb); err != nil {
 		return fmt.Errorf("cargo deb: %w", err)
 	}
 
@@ -789,12 +1378,12 @@ func cloneCargoSrc(cargo cargoType, dir string) error {
 		return fmt.Errorf("creating cargo src parent: %w", err)
 	}
 
-	if err := runCommand("", "git", "clone", cargo.Url, dir); err != nil {
+	if err := runCommand(cargo.Name, "", "git", "clone", cargo.Url, dir); err != nil {
 		return fmt.Errorf("cloning %s: %w", cargo.Url, err)
 	}
 
 	if cargo.Version != "" {
-		if err := runCommand(dir, "git", "checkout", cargo.Version); err != nil {
+		if err := runCommand(cargo.Name, dir, "git", "checkout", cargo.Version); err != nil {
 			return fmt.Errorf("checking out ref %s: %w", cargo.Version, err)
 		}
 	}
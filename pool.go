@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"sync"
+)
+
+// job is one unit of work for runJobs, usually one package for one arch.
+// run gets a logger tagged with the package (and arch) so interleaved
+// output from parallel jobs stays readable.
+type job struct {
+	pkg  string
+	arch string
+	run  func(logger *slog.Logger) error
+}
+
+func (j job) String() string {
+	if j.arch == "" {
+		return j.pkg
+	}
+	return j.pkg + "/" + j.arch
+}
+
+// runJobs runs jobs with at most n at a time. A failing job doesn't stop
+// the others; all errors are returned together.
+func runJobs(jobs []job, n int) error {
+	if n < 1 {
+		n = 1
+	}
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+		sem  = make(chan struct{}, n)
+	)
+	for _, j := range jobs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			logger := slog.With("package", j.pkg)
+			if j.arch != "" {
+				logger = logger.With("arch", j.arch)
+			}
+			if err := j.run(logger); err != nil {
+				logger.Error("failed", "error", err)
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("%s: %w", j, err))
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+var (
+	// hostJobs is the number of concurrent downloads per host, set by
+	// --host-jobs.
+	hostJobs = 4
+
+	hostSemsMu sync.Mutex
+	hostSems   = map[string]chan struct{}{}
+)
+
+// limitHost blocks until a download slot for rawURL's host is free and
+// returns the function releasing it.
+func limitHost(rawURL string) func() {
+	host := rawURL
+	if u, err := url.Parse(rawURL); err == nil {
+		host = u.Host
+	}
+
+	hostSemsMu.Lock()
+	sem, ok := hostSems[host]
+	if !ok {
+		sem = make(chan struct{}, max(hostJobs, 1))
+		hostSems[host] = sem
+	}
+	hostSemsMu.Unlock()
+
+	sem <- struct{}{}
+	return func() { <-sem }
+}
+
+// prefixWriter prefixes every line written to w, so the output of commands
+// run by parallel jobs can be told apart.
+type prefixWriter struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	prefix []byte
+	buf    []byte
+}
+
+// outputMu serializes the lines of all prefixWriters.
+var outputMu sync.Mutex
+
+func newPrefixWriter(w io.Writer, tag string) *prefixWriter {
+	return &prefixWriter{mu: &outputMu, w: w, prefix: []byte("[" + tag + "] ")}
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.buf = append(p.buf, b...)
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			return len(b), nil
+		}
+		if err := p.writeLine(p.buf[:i+1]); err != nil {
+			return 0, err
+		}
+		p.buf = p.buf[i+1:]
+	}
+}
+
+// Flush writes a trailing line without a newline.
+func (p *prefixWriter) Flush() error {
+	if len(p.buf) == 0 {
+		return nil
+	}
+	line := append(p.buf, '\n')
+	p.buf = nil
+	return p.writeLine(line)
+}
+
+func (p *prefixWriter) writeLine(line []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, err := p.w.Write(p.prefix); err != nil {
+		return err
+	}
+	_, err := p.w.Write(line)
+	return err
+}
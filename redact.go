@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+var (
+	secretsMu sync.RWMutex
+	secrets   []string
+
+	// urlPasswordRe matches the password of a user:password@ URL.
+	urlPasswordRe = regexp.MustCompile(`(://[^/@:\s]+):[^/@\s]+@`)
+)
+
+// redactSecret makes the redact handler hide secret from all log output.
+func redactSecret(secret string) {
+	if secret == "" {
+		return
+	}
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	secrets = append(secrets, secret)
+}
+
+func redact(s string) string {
+	s = urlPasswordRe.ReplaceAllString(s, "$1:REDACTED@")
+
+	secretsMu.RLock()
+	defer secretsMu.RUnlock()
+	for _, secret := range secrets {
+		s = strings.ReplaceAll(s, secret, "REDACTED")
+	}
+	return s
+}
+
+// redactHandler replaces credentials in log messages and attributes,
+// including errors that wrap a request URL or header.
+type redactHandler struct {
+	slog.Handler
+}
+
+func (h redactHandler) Handle(ctx context.Context, r slog.Record) error {
+	out := slog.NewRecord(r.Time, r.Level, redact(r.Message), r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		out.AddAttrs(redactAttr(a))
+		return true
+	})
+	return h.Handler.Handle(ctx, out)
+}
+
+func (h redactHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redacted[i] = redactAttr(a)
+	}
+	return redactHandler{h.Handler.WithAttrs(redacted)}
+}
+
+func (h redactHandler) WithGroup(name string) slog.Handler {
+	return redactHandler{h.Handler.WithGroup(name)}
+}
+
+func redactAttr(a slog.Attr) slog.Attr {
+	value := a.Value.Resolve()
+	switch value.Kind() {
+	case slog.KindGroup:
+		attrs := value.Group()
+		redacted := make([]slog.Attr, len(attrs))
+		for i, attr := range attrs {
+			redacted[i] = redactAttr(attr)
+		}
+		return slog.Attr{Key: a.Key, Value: slog.GroupValue(redacted...)}
+	case slog.KindString:
+		return slog.String(a.Key, redact(value.String()))
+	case slog.KindAny:
+		// Errors, URLs and the like are logged through their text.
+		if err, ok := value.Any().(error); ok {
+			return slog.String(a.Key, redact(err.Error()))
+		}
+		if s, ok := value.Any().(interface{ String() string }); ok {
+			return slog.String(a.Key, redact(s.String()))
+		}
+	}
+	return slog.Attr{Key: a.Key, Value: value}
+}
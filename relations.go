@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// relationType is one entry of a dependency field such as depends or
+// conflicts. In YAML it is either a plain string, copied to the control file
+// as is (so "foo (>= 1.2) | bar" works), or a mapping:
+//
+//	depends:
+//	  - libc6
+//	  - name: libgtk-3-0
+//	    version: ">= 3.22"
+//	    architectures: [amd64]
+type relationType struct {
+	Name    string `yaml:"name"`
+	Version string `yaml:"version"`
+	// Architectures limits the entry to these deb architectures; empty
+	// means every architecture.
+	Architectures []string `yaml:"architectures"`
+}
+
+func (r *relationType) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		r.Name = strings.TrimSpace(value.Value)
+		return nil
+	}
+	type plain relationType
+	return value.Decode((*plain)(r))
+}
+
+func (r relationType) validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("relation without a name")
+	}
+	if strings.ContainsAny(r.Name, ",\n") {
+		return fmt.Errorf("relation %q: use one list entry per package", r.Name)
+	}
+	if r.Version != "" {
+		op, ver, _ := strings.Cut(strings.TrimSpace(r.Version), " ")
+		if !slices.Contains([]string{"<<", "<=", "=", ">=", ">>"}, op) || strings.TrimSpace(ver) == "" {
+			return fmt.Errorf("relation %s: version %q must look like \">= 1.0\"", r.Name, r.Version)
+		}
+	}
+	return nil
+}
+
+func (r relationType) String() string {
+	if r.Version == "" {
+		return r.Name
+	}
+	op, ver, _ := strings.Cut(strings.TrimSpace(r.Version), " ")
+	return fmt.Sprintf("%s (%s %s)", r.Name, op, strings.TrimSpace(ver))
+}
+
+// relationsType holds the package relationship fields of a release_asset
+// package, in the order dpkg documents them.
+type relationsType struct {
+	Depends    []relationType `yaml:"depends"`
+	Recommends []relationType `yaml:"recommends"`
+	Suggests   []relationType `yaml:"suggests"`
+	Conflicts  []relationType `yaml:"conflicts"`
+	Breaks     []relationType `yaml:"breaks"`
+	Replaces   []relationType `yaml:"replaces"`
+	Provides   []relationType `yaml:"provides"`
+}
+
+func (r relationsType) fields() []struct {
+	key       string
+	relations []relationType
+} {
+	return []struct {
+		key       string
+		relations []relationType
+	}{
+		{"Depends", r.Depends},
+		{"Recommends", r.Recommends},
+		{"Suggests", r.Suggests},
+		{"Conflicts", r.Conflicts},
+		{"Breaks", r.Breaks},
+		{"Replaces", r.Replaces},
+		{"Provides", r.Provides},
+	}
+}
+
+func (r relationsType) validate() error {
+	for _, field := range r.fields() {
+		for _, rel := range field.relations {
+			if err := rel.validate(); err != nil {
+				return fmt.Errorf("%s: %w", strings.ToLower(field.key), err)
+			}
+		}
+	}
+	return nil
+}
+
+// relationFields renders the relationship fields for arch, dropping entries
+// limited to other architectures and fields left empty.
+func (r relationsType) relationFields(arch string) controlStanza {
+	var stanza controlStanza
+	for _, field := range r.fields() {
+		var entries []string
+		for _, rel := range field.relations {
+			if len(rel.Architectures) > 0 && !slices.Contains(rel.Architectures, arch) {
+				continue
+			}
+			entries = append(entries, rel.String())
+		}
+		stanza = append(stanza, controlField{Key: field.key, Value: strings.Join(entries, ", ")})
+	}
+	return stanza.withoutEmpty()
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+)
+
+// loadSigningKey reads the OpenPGP private key used to sign the repository
+// from keyFile, or else from the environment variable keyEnv. The key may be
+// armored or binary; a protected key is unlocked with the passphrase in
+// passphraseEnv. It returns nil when neither source is set.
+func loadSigningKey(keyFile string, keyEnv string, passphraseEnv string) (*openpgp.Entity, error) {
+	var keyData []byte
+	switch {
+	case keyFile != "":
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading signing key: %w", err)
+		}
+		keyData = data
+	case keyEnv != "" && os.Getenv(keyEnv) != "":
+		keyData = []byte(os.Getenv(keyEnv))
+	default:
+		return nil, nil
+	}
+
+	keyring, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(keyData))
+	if err != nil {
+		keyring, err = openpgp.ReadKeyRing(bytes.NewReader(keyData))
+		if err != nil {
+			return nil, fmt.Errorf("parsing signing key: %w", err)
+		}
+	}
+	if len(keyring) != 1 {
+		return nil, fmt.Errorf("signing key must hold exactly one key, found %d", len(keyring))
+	}
+	entity := keyring[0]
+	if entity.PrivateKey == nil {
+		return nil, errors.New("signing key has no private key")
+	}
+
+	if entity.PrivateKey.Encrypted {
+		passphrase := os.Getenv(passphraseEnv)
+		redactSecret(passphrase)
+		if passphrase == "" {
+			return nil, fmt.Errorf("signing key is passphrase protected but $%s is empty", passphraseEnv)
+		}
+		if err := entity.DecryptPrivateKeys([]byte(passphrase)); err != nil {
+			return nil, fmt.Errorf("unlocking signing key: %w", err)
+		}
+	}
+
+	if _, ok := entity.SigningKey(time.Now()); !ok {
+		return nil, errors.New("signing key has no valid signing (sub)key")
+	}
+	return entity, nil
+}
+
+// signRelease writes InRelease (clearsigned) and Release.gpg (detached,
+// armored) next to distDir/Release.
+func signRelease(distDir string, signer *openpgp.Entity) error {
+	release, err := os.ReadFile(filepath.Join(distDir, "Release"))
+	if err != nil {
+		return err
+	}
+
+	key, ok := signer.SigningKey(time.Now())
+	if !ok {
+		return errors.New("signing key has no valid signing (sub)key")
+	}
+
+	var inRelease bytes.Buffer
+	plaintext, err := clearsign.Encode(&inRelease, key.PrivateKey, nil)
+	if err != nil {
+		return fmt.Errorf("clearsigning Release: %w", err)
+	}
+	if _, err := plaintext.Write(release); err != nil {
+		return err
+	}
+	if err := plaintext.Close(); err != nil {
+		return fmt.Errorf("clearsigning Release: %w", err)
+	}
+	inRelease.WriteString("\n")
+	if err := os.WriteFile(filepath.Join(distDir, "InRelease"), inRelease.Bytes(), 0o644); err != nil {
+		return err
+	}
+
+	var detached bytes.Buffer
+	if err := openpgp.ArmoredDetachSign(&detached, signer, bytes.NewReader(release), nil); err != nil {
+		return fmt.Errorf("signing Release: %w", err)
+	}
+	detached.WriteString("\n")
+	return os.WriteFile(filepath.Join(distDir, "Release.gpg"), detached.Bytes(), 0o644)
+}
+
+// exportPublicKey writes the public half of signer into repoDir as a binary
+// keyring (public.gpg, for /etc/apt/keyrings and Signed-By) and armored
+// (public.asc).
+func exportPublicKey(repoDir string, signer *openpgp.Entity) error {
+	var binary bytes.Buffer
+	if err := signer.Serialize(&binary); err != nil {
+		return fmt.Errorf("serializing public key: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(repoDir, "public.gpg"), binary.Bytes(), 0o644); err != nil {
+		return err
+	}
+
+	var armored bytes.Buffer
+	w, err := armor.Encode(&armored, openpgp.PublicKeyType, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(binary.Bytes()); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	armored.WriteString("\n")
+	if err := os.WriteFile(filepath.Join(repoDir, "public.asc"), armored.Bytes(), 0o644); err != nil {
+		return err
+	}
+
+	slog.Info("Exported repository key", "fingerprint", fmt.Sprintf("%X", signer.PrimaryKey.Fingerprint))
+	return nil
+}
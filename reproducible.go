@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// SourceDate returns the timestamp the app's .deb is normalized to: the
+// per-package source_date_epoch, else $SOURCE_DATE_EPOCH, else the zero time
+// (reproducible mode off).
+func (app appType) SourceDate() (time.Time, error) {
+	if app.SourceDateEpoch != nil {
+		return time.Unix(*app.SourceDateEpoch, 0).UTC(), nil
+	}
+
+	env := os.Getenv("SOURCE_DATE_EPOCH")
+	if env == "" {
+		return time.Time{}, nil
+	}
+
+	epoch, err := strconv.ParseInt(env, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid SOURCE_DATE_EPOCH %q: %w", env, err)
+	}
+	return time.Unix(epoch, 0).UTC(), nil
+}
+
+// verifyReproducible builds every app twice from the same downloaded asset
+// and compares the SHA-256 of the results. The first build is written to
+// the usual tmp/<arch>/ location so it can also be compared against the
+// published package; the second goes to tmp/verify/<arch>/.
+func verifyReproducible(apps []appType) error {
+	var failed []string
+
+	for _, app := range apps {
+		sourceDate, err := app.SourceDate()
+		if err != nil {
+			return err
+		}
+		if sourceDate.IsZero() {
+			return fmt.Errorf("%s: set SOURCE_DATE_EPOCH or source_date_epoch to build reproducibly", app.Name)
+		}
+
+		for _, arch := range filterArchs(app.Architectures) {
+			appDir := filepath.Join("tmp", "app", app.Name, arch.deb)
+			debName := fmt.Sprintf("%s_%s_%s.deb", app.Name, app.Version, arch.deb)
+
+			logger := slog.With("package", app.Name, "arch", arch.deb)
+			asset, err := fetchAppAsset(logger, app, arch, appDir)
+			if err != nil {
+				return err
+			}
+
+			var sums []string
+			for _, outDeb := range []string{filepath.Join("tmp", arch.deb, debName), filepath.Join("tmp", "verify", arch.deb, debName)} {
+				if err := buildApp(logger, app, arch, appDir, asset, outDeb); err != nil {
+					return fmt.Errorf("building %s: %w", debName, err)
+				}
+				sum, err := fileSHA256(outDeb)
+				if err != nil {
+					return err
+				}
+				sums = append(sums, sum)
+			}
+
+			if sums[0] != sums[1] {
+				slog.Error("not reproducible", "deb", debName, "first", sums[0], "second", sums[1])
+				failed = append(failed, debName)
+				continue
+			}
+			slog.Info("reproducible", "deb", debName, "sha256", sums[0])
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("%d package(s) are not reproducible: %v", len(failed), failed)
+	}
+	return nil
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = f.Close() }()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return "", fmt.Errorf("hashing %s: %w", path, err)
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
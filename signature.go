@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	"aead.dev/minisign"
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+// signatureType describes a detached signature published next to a release
+// asset and the public key, checked into this repo, it must verify against.
+type signatureType struct {
+	// URL is a template resolved through ProcessURL, e.g.
+	// "https://.../{{ version }}/tool.tar.gz.asc".
+	URL string `yaml:"url"`
+	// Type is "openpgp" (armored .asc or binary .sig) or "minisign".
+	Type string `yaml:"type"`
+	// Key is the path of the trusted public key relative to the repo root.
+	Key string `yaml:"key"`
+}
+
+func (sig *signatureType) validate() error {
+	if sig == nil {
+		return nil
+	}
+	if sig.URL == "" {
+		return fmt.Errorf("signature.url is required")
+	}
+	switch sig.Type {
+	case "openpgp", "minisign":
+	default:
+		return fmt.Errorf("unknown signature.type %q (want \"openpgp\" or \"minisign\")", sig.Type)
+	}
+	if _, err := os.Stat(sig.Key); err != nil {
+		return fmt.Errorf("signature.key: %w", err)
+	}
+	return nil
+}
+
+// verifySignature downloads the detached signature at sigURL and checks file
+// against it. A file that fails verification is removed so it can't be
+// picked up by a later run.
+func verifySignature(logger *slog.Logger, sig *signatureType, file string, sigURL string) error {
+	if sig == nil {
+		return nil
+	}
+	defer warnTime("verifySignature "+file, 5*time.Second)()
+
+	signature, err := fetchBytes(logger, sigURL)
+	if err != nil {
+		return fmt.Errorf("downloading signature: %w", err)
+	}
+
+	switch sig.Type {
+	case "openpgp":
+		err = verifyOpenPGP(sig.Key, file, signature)
+	case "minisign":
+		err = verifyMinisign(sig.Key, file, signature)
+	default:
+		err = fmt.Errorf("unknown signature type %q", sig.Type)
+	}
+	if err != nil {
+		_ = os.Remove(file)
+		return fmt.Errorf("verifying %s signature %s: %w", sig.Type, sigURL, err)
+	}
+
+	logger.Debug("signature verified", "file", file, "type", sig.Type, "key", sig.Key)
+	return nil
+}
+
+func verifyOpenPGP(keyPath string, file string, signature []byte) error {
+	keyData, err := os.ReadFile(keyPath)
+	if err != nil {
+		return fmt.Errorf("reading key: %w", err)
+	}
+
+	keyring, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(keyData))
+	if err != nil {
+		keyring, err = openpgp.ReadKeyRing(bytes.NewReader(keyData))
+		if err != nil {
+			return fmt.Errorf("parsing key %s: %w", keyPath, err)
+		}
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	if bytes.HasPrefix(bytes.TrimSpace(signature), []byte("-----BEGIN PGP SIGNATURE-----")) {
+		_, err = openpgp.CheckArmoredDetachedSignature(keyring, f, bytes.NewReader(signature), nil)
+	} else {
+		_, err = openpgp.CheckDetachedSignature(keyring, f, bytes.NewReader(signature), nil)
+	}
+	return err
+}
+
+func verifyMinisign(keyPath string, file string, signature []byte) error {
+	publicKey, err := minisign.PublicKeyFromFile(keyPath)
+	if err != nil {
+		return fmt.Errorf("parsing key %s: %w", keyPath, err)
+	}
+
+	var parsed minisign.Signature
+	if err := parsed.UnmarshalText(signature); err != nil {
+		return fmt.Errorf("parsing signature: %w", err)
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	var ok bool
+	if parsed.Algorithm == minisign.HashEdDSA {
+		// Prehashed signatures can be checked while streaming the file.
+		reader := minisign.NewReader(f)
+		if _, err := io.Copy(io.Discard, reader); err != nil {
+			return fmt.Errorf("reading %s: %w", file, err)
+		}
+		ok = reader.Verify(publicKey, signature)
+	} else {
+		message, err := io.ReadAll(f)
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", file, err)
+		}
+		ok = minisign.Verify(publicKey, message, signature)
+	}
+	if !ok {
+		return fmt.Errorf("signature does not match key %s", keyPath)
+	}
+	return nil
+}
+
+// fetchBytes downloads a small file, such as a signature or checksum
+// manifest, into memory.
+func fetchBytes(logger *slog.Logger, url string) ([]byte, error) {
+	defer limitHost(url)()
+
+	var buf bufferSink
+	if err := download(logger, url, &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// templateFuncs returns the functions URL templates can use. Variables are
+// exposed as functions without arguments so the `{{ version }}` syntax keeps
+// working; an unknown name fails when the template is parsed.
+//
+//	{{ name }}, {{ version }}        the package name and version
+//	{{ bare_version }}               version without a leading "v"
+//	{{ major }}, {{ minor }}, {{ patch }}
+//	{{ deb_architecture }}           and {{ <alias>_architecture }} for every
+//	                                 alias in architectures.yaml
+//	{{ title x }}, {{ replace old new x }}, {{ trimPrefix prefix x }}
+func templateFuncs(name string, version string, arch archType) template.FuncMap {
+	bare := strings.TrimPrefix(version, "v")
+	core, _, _ := strings.Cut(bare, "-")
+	core, _, _ = strings.Cut(core, "+")
+	parts := strings.SplitN(core, ".", 3)
+	for len(parts) < 3 {
+		parts = append(parts, "")
+	}
+
+	funcs := template.FuncMap{
+		"name":             constFunc(name),
+		"version":          constFunc(version),
+		"bare_version":     constFunc(bare),
+		"major":            constFunc(parts[0]),
+		"minor":            constFunc(parts[1]),
+		"patch":            constFunc(parts[2]),
+		"deb_architecture": constFunc(arch.deb),
+		"title":            titleCase,
+		"replace":          func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+		"trimPrefix":       func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+	}
+	for alias, value := range arch.aliases {
+		funcs[alias+"_architecture"] = constFunc(value)
+	}
+	return funcs
+}
+
+func constFunc(value string) func() string {
+	return func() string { return value }
+}
+
+// titleCase upper-cases the first letter of every word, e.g. "linux" ->
+// "Linux" for assets like SubtitleEdit-Linux-x64.tar.gz.
+func titleCase(s string) string {
+	words := strings.Fields(s)
+	for i, word := range words {
+		words[i] = strings.ToUpper(word[:1]) + word[1:]
+	}
+	return strings.Join(words, " ")
+}
+
+// urlRewriteType replaces the prefix of a rendered URL, set by
+// --mirror-rewrite to send e.g. every github.com download through a proxy.
+type urlRewriteType struct {
+	prefix      string
+	replacement string
+}
+
+var urlRewrites []urlRewriteType
+
+// parseURLRewrite parses a --mirror-rewrite value, PREFIX=REPLACEMENT.
+func parseURLRewrite(value string) (urlRewriteType, error) {
+	prefix, replacement, ok := strings.Cut(value, "=")
+	if !ok || prefix == "" || replacement == "" {
+		return urlRewriteType{}, fmt.Errorf("invalid mirror rewrite %q, expected PREFIX=REPLACEMENT", value)
+	}
+	return urlRewriteType{prefix: prefix, replacement: replacement}, nil
+}
+
+// rewriteURL applies the first rewrite whose prefix matches url.
+func rewriteURL(url string) string {
+	for _, rewrite := range urlRewrites {
+		if rest, ok := strings.CutPrefix(url, rewrite.prefix); ok {
+			return rewrite.replacement + rest
+		}
+	}
+	return url
+}
+
+// ProcessURL renders the text/template url for a package version and arch.
+func ProcessURL(url string, name string, version string, arch archType) (string, error) {
+	if !strings.Contains(url, "{{") {
+		return url, nil
+	}
+
+	tmpl, err := template.New("url").Option("missingkey=error").Funcs(templateFuncs(name, version, arch)).Parse(url)
+	if err != nil {
+		return "", fmt.Errorf("parsing template %q: %w", url, err)
+	}
+
+	var out strings.Builder
+	if err := tmpl.Execute(&out, nil); err != nil {
+		return "", fmt.Errorf("rendering template %q: %w", url, err)
+	}
+	return out.String(), nil
+}
+
+// processFetchURL renders url like ProcessURL and applies the
+// --mirror-rewrite rules. It's for URLs that are downloaded; templates that
+// aren't, like cosign's certificate_identity, must not be rewritten.
+func processFetchURL(url string, name string, version string, arch archType) (string, error) {
+	rendered, err := ProcessURL(url, name, version, arch)
+	if err != nil {
+		return "", err
+	}
+	return rewriteURL(rendered), nil
+}
+
+// processURLs renders each of urls with processFetchURL.
+func processURLs(urls []string, name string, version string, arch archType) ([]string, error) {
+	rendered := make([]string, len(urls))
+	for i, url := range urls {
+		var err error
+		if rendered[i], err = processFetchURL(url, name, version, arch); err != nil {
+			return nil, err
+		}
+	}
+	return rendered, nil
+}
+
+// validateTemplate parses url with every variable defined so a typo in a
+// package file fails when it's loaded rather than halfway through a build.
+func validateTemplate(url string) error {
+	_, err := ProcessURL(url, "", "", archAll)
+	return err
+}
+
+// validateTemplates checks every templated field of a package file.
+func (app appType) validateTemplates() error {
+	templates := map[string]string{
+		"url":          app.Url,
+		"checksum_url": app.ChecksumUrl,
+	}
+	for arch, url := range app.UrlOverrides {
+		templates["url_overrides."+arch] = url
+	}
+	for i, url := range app.Mirrors {
+		templates[fmt.Sprintf("mirrors.%d", i)] = url
+	}
+	for arch, urls := range app.MirrorOverrides {
+		for i, url := range urls {
+			templates[fmt.Sprintf("mirror_overrides.%s.%d", arch, i)] = url
+		}
+	}
+	if app.Signature != nil {
+		templates["signature.url"] = app.Signature.URL
+	}
+	if app.Cosign != nil {
+		templates["cosign.bundle_url"] = app.Cosign.BundleURL
+		templates["cosign.certificate_identity"] = app.Cosign.CertificateIdentity
+	}
+	for i, extraFile := range app.ExtraFiles {
+		templates[fmt.Sprintf("extra_files.%d.url", i)] = extraFile.URL
+	}
+
+	for field, url := range templates {
+		if err := validateTemplate(url); err != nil {
+			return fmt.Errorf("%s: %w", field, err)
+		}
+	}
+	return nil
+}